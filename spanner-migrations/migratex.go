@@ -6,29 +6,55 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 	"unicode"
 
 	"cloud.google.com/go/spanner"
 	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	instance "cloud.google.com/go/spanner/admin/instance/apiv1"
+	sppb "cloud.google.com/go/spanner/apiv1/spannerpb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 	adminpb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+	instancepb "google.golang.org/genproto/googleapis/spanner/admin/instance/v1"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
 )
 
 type Severity int
@@ -56,83 +82,359 @@ const (
 var (
 	l *logger
 
+	configFile        string
 	envId             string
 	gcpProjectId      string
 	spannerInstanceId string
 	spannerDatabaseId string
+	tokenFile         string
 	timeout           int
+	logFormat         string
+	logLevel          string
+	logEnvAllowlist   string
+	reportJson        string
+	reportJunit       string
+	interruptDdl      bool
+	otelExporter      string
+	otelEndpoint      string
+
+	databasesFile   string
+	databasePattern string
+	parallelism     int
+	canary          int
+	failFast        bool
+	fleetTimeout    int
+
+	baselineDdlVersion int64
+	baselineDmlVersion int64
+	force              bool
+
+	squashUpto int64
+	archiveDir string
+
+	schemaFile  string
+	dumpSchema  bool
+	checkSchema bool
+
+	expectedSchema string
+	emulatorHost   string
+	useEmulator    bool
+
+	verifyAllEnvs bool
+
+	databaseDialect string
+
+	stream     string
+	useHistory bool
+	outOfOrder bool
 )
 
+const (
+	commandUp         = "up"
+	commandFleet      = "fleet"
+	commandBaseline   = "baseline"
+	commandSquash     = "squash"
+	commandDumpSchema = "dump-schema"
+	commandDrift      = "drift"
+	commandVerify     = "verify"
+	commandStatus     = "status"
+)
+
+// commandLineFlags are the flags set on the command line, with their values, before any are resolved from elsewhere
+var commandLineFlags map[string]string
+
+var commands = []string{commandUp, commandFleet, commandBaseline, commandSquash, commandDumpSchema, commandDrift, commandVerify, commandStatus}
+
 func init() {
-	l = newDefaultLogger(true)
+	l = newDefaultLogger(false)
 
+	flag.StringVar(&configFile, "config", "", fmt.Sprintf("The config file, defaults to %q in the working directory if it exists", defaultConfigFile))
 	flag.StringVar(&envId, "env_id", "", "The environment ID of the spanner instance")
+	flag.StringVar(&envId, "env", "", "Shorthand for -env_id")
 	flag.StringVar(&gcpProjectId, "gcp_project_id", "", "The GCP project ID of the spanner instance")
 	flag.StringVar(&spannerInstanceId, "spanner_instance_id", "", "The ID of the spanner instance")
 	flag.StringVar(&spannerDatabaseId, "spanner_database_id", "", "The ID of the spanner database")
+	flag.StringVar(&tokenFile, "token_file", "", "A JSON token definition file applied to every DML migration")
 	flag.IntVar(&timeout, "timeout", 60, "The timeout in minutes")
+	flag.StringVar(&logFormat, "log_format", logFormatText, fmt.Sprintf("The log format, either %q or %q", logFormatText, logFormatJson))
+	flag.StringVar(&logLevel, "log_level", "info", "The minimum level logged, one of debug, info, notice, warning or error")
+	flag.BoolVar(&interruptDdl, "interrupt_ddl", false, "When interrupted, interrupt an in-flight DDL migration rather than waiting for it to finish")
+	flag.StringVar(&otelExporter, "otel_exporter", otelExporterNone, fmt.Sprintf("The OpenTelemetry exporter for traces and metrics, one of %q, %q or %q", otelExporterNone, otelExporterStdout, otelExporterOtlp))
+	flag.StringVar(&otelEndpoint, "otel_endpoint", "", "The OTLP gRPC endpoint URL, e.g. http://localhost:4317, defaults to OTEL_EXPORTER_OTLP_ENDPOINT")
+	flag.StringVar(&reportJson, "report_json", "", "up: Write a JSON report of the run to this file")
+	flag.StringVar(&reportJunit, "report_junit", "", "up: Write a JUnit XML report of the run to this file")
+	flag.StringVar(&logEnvAllowlist, "log_env_allowlist", "", "Comma separated environment variables, optionally ending in '*', whose values are logged in addition to the defaults")
+
+	flag.StringVar(&databasesFile, "databases_file", "", "fleet: A file listing the IDs of the spanner databases to migrate, one per line")
+	flag.StringVar(&databasePattern, "database_pattern", "", "fleet: Migrate the spanner databases in the instance whose IDs match this regular expression")
+	flag.IntVar(&parallelism, "parallelism", 4, "fleet: The maximum number of spanner databases migrated at the same time")
+	flag.IntVar(&canary, "canary", 0, "fleet: The number of spanner databases migrated first, on their own, before the rest")
+	flag.BoolVar(&failFast, "fail_fast", false, "fleet: Stop starting migrations of further spanner databases after the first failure")
+	flag.IntVar(&fleetTimeout, "fleet_timeout", 0, "fleet: The timeout in minutes of the whole fleet, if any, where each spanner database is migrated within -timeout")
+
+	flag.Int64Var(&baselineDdlVersion, "ddl_version", 0, "baseline: The DDL migration version to mark as applied in SchemaMigrations, or up to which DDL migrations are marked as applied in MigrationHistory with -history")
+	flag.Int64Var(&baselineDmlVersion, "dml_version", 0, "baseline: The DML migration version to mark as applied in DataMigrations, or up to which DML migrations are marked as applied in MigrationHistory with -history")
+	flag.BoolVar(&force, "force", false, "baseline: Replace any existing migration history")
+
+	flag.Int64Var(&squashUpto, "upto", 0, "squash: The last revision squashed into the baseline DDL migration")
+	flag.StringVar(&archiveDir, "archive_dir", "archive", "squash: The directory, relative to the working directory, the squashed migrations are moved to")
 
-	flag.Parse()
+	flag.StringVar(&schemaFile, "schema_file", defaultSchemaFile, "The schema file, relative to the working directory, written by dump-schema")
+	flag.BoolVar(&dumpSchema, "dump_schema", false, "up: Dump the schema to the schema file after a successful run")
+	flag.StringVar(&expectedSchema, "expected", expectedSchemaSnapshot, fmt.Sprintf("drift: Where the expected schema comes from, either %q for the schema file or %q for replaying the DDL migrations into the emulator", expectedSchemaSnapshot, expectedSchemaEmulator))
+	flag.StringVar(&emulatorHost, "emulator_host", "", fmt.Sprintf("The host and port of the spanner emulator, defaults to SPANNER_EMULATOR_HOST or %q", defaultEmulatorHost))
+	flag.BoolVar(&useEmulator, "emulator", false, "Migrate a database in the spanner emulator, creating its instance and database if necessary")
+	flag.StringVar(&databaseDialect, "database_dialect", dialectGoogleSql, fmt.Sprintf("The dialect of databases created in the emulator, either %q or %q, the dialect of existing databases is detected", dialectGoogleSql, dialectPostgresql))
+	flag.StringVar(&stream, "stream", "", "The migration stream, whose migrations are tracked in their own SchemaMigrations_[STREAM] and DataMigrations_[STREAM] tables, or the one stream in the config file to migrate")
+	flag.BoolVar(&useHistory, "history", false, "Track every applied migration in its own row of the MigrationHistory table, converting SchemaMigrations and DataMigrations when it is empty")
+	flag.BoolVar(&outOfOrder, "out_of_order", false, "up: Apply outstanding migrations that come before the last applied migration, such as those of late merged branches, which requires -history")
+	flag.BoolVar(&verifyAllEnvs, "all_envs", false, "verify: Verify the migrations of every declared environment in turn rather than of env_id")
+	flag.BoolVar(&checkSchema, "check", false, "dump-schema, up -dump_schema: Fail if the schema file differs from the schema rather than writing it")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [%s] [flags]\n", os.Args[0], strings.Join(commands, "|"))
+		flag.PrintDefaults()
+	}
 }
 
 func main() {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Minute)
+	defer exitOnFatal()
+
+	command, err := parseCommandLine(os.Args[1:])
+	if err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed parsing command line: %v", err))
+	}
+	if err := configureLogger(); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed configuring logging: %v", err))
+	}
+
+	workingDir, err := os.Getwd()
+	if err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed determining working directory: %v", err))
+	}
+	logDebug(fmt.Sprintf("Determined working directory %q", workingDir))
+
+	config := loadConfig(workingDir)
+	if err := resolveSettings(config); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed resolving settings: %v", err))
+	}
+	if err := configureLogger(); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed configuring logging: %v", err))
+	}
+	if command == commandVerify {
+		useEmulator = true
+	}
+	resolveEmulatorSettings()
+	if err := resolveDialect(); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed resolving settings: %v", err))
+	}
+
+	ctx, cancel := runContext(command)
 	defer cancel()
+	cancelOnInterrupt(cancel)
+
+	if config != nil {
+		for _, v := range config.SecretTokens {
+			secretTokens[v] = true
+		}
+	}
+
+	logDebug(fmt.Sprintf("Starting in env: %v", map[string][]string{"os.Environ()": redactedEnviron()}))
+
+	shutdownTelemetry := setupTelemetry(ctx)
+	defer shutdownTelemetry()
+
+	ctx, span := startSpan(ctx, "migratex."+command)
+	defer endSpan(span)
+
+	if useEmulator {
+		// The fleet command only lists the databases, each is created by its own migratex process, and verify creates
+		// a new database for every environment
+		setupEmulator(ctx, command != commandFleet && command != commandVerify)
+	}
+
+	switch command {
+	case commandUp:
+		up(ctx, workingDir, config)
+	case commandFleet:
+		fleet(ctx, workingDir, config)
+	case commandBaseline:
+		baseline(ctx, workingDir, config)
+	case commandSquash:
+		squash(ctx, singleStream(workingDir, config).Dir)
+	case commandDumpSchema:
+		logDebug(fmt.Sprintf("Checking args"))
+		if err := checkArgs(); err != nil {
+			logFatal(errConfiguration, fmt.Sprintf("Failed checking required command line arguments: %v", err))
+		}
+		logDebug(fmt.Sprintf("Checked args"))
+		dumpDatabaseSchema(ctx, workingDir)
+	case commandDrift:
+		drift(ctx, workingDir, config)
+	case commandVerify:
+		verify(ctx, workingDir, config)
+	case commandStatus:
+		showStatus(ctx, workingDir, config)
+	}
+}
+
+// runContext returns the context of the run, which times out after -timeout, except for fleet where each database is
+// migrated within -timeout in its own process and the whole fleet only times out after -fleet_timeout, if given
+func runContext(command string) (context.Context, context.CancelFunc) {
+	if command != commandFleet {
+		return context.WithTimeout(context.Background(), time.Duration(timeout)*time.Minute)
+	}
+	if fleetTimeout > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(fleetTimeout)*time.Minute)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// parseCommandLine parses the command and its flags, where the command defaults to `up` so that running migratex with
+// only flags keeps working
+func parseCommandLine(args []string) (string, error) {
+	command := commandUp
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+
+	known := false
+	for _, v := range commands {
+		known = known || v == command
+	}
+	if !known {
+		flag.Usage()
+		return "", fmt.Errorf("unknown command %q", command)
+	}
+
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return "", err
+	}
+	if flag.NArg() > 0 {
+		return "", fmt.Errorf("unexpected arguments %v", flag.Args())
+	}
+	commandLineFlags = make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = f.Value.String()
+	})
+	return command, nil
+}
 
-	logDebug(fmt.Sprintf("Starting in env: %v", map[string][]string{"os.Environ()": os.Environ()}))
+func up(ctx context.Context, workingDir string, config *config) {
+	report = newRunReport()
+	runHooks = newHooks(config)
+	defer func() {
+		r := recover()
+		if r == nil && dumpSchema {
+			r = catchFatal(func() {
+				dumpDatabaseSchema(ctx, workingDir)
+			})
+		}
+		if r == nil {
+			r = catchFatal(func() {
+				runHooks.run(ctx, hookAfterRun, hookEnv{})
+			})
+		}
+		if r != nil {
+			runHooks.runOnFailure(r)
+		}
+		runHooks.close()
+		report.finish(r)
+		writeReports()
+		if r != nil {
+			panic(r)
+		}
+	}()
 
 	logDebug(fmt.Sprintf("Checking args"))
 	if err := checkArgs(); err != nil {
-		logFatal(fmt.Sprintf("Failed checking required command line arguments: %v", err))
+		logFatal(errConfiguration, fmt.Sprintf("Failed checking required command line arguments: %v", err))
 	}
 	logDebug(fmt.Sprintf("Checked args"))
 
 	databseConnection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
 
-	logDebug(fmt.Sprintf("Using envId=%q, gcpProjectId=%q, spannerInstanceId=%q, spannerDatabaseId=%q, databseConnection=%q, timeout=%d", envId, gcpProjectId, spannerInstanceId, spannerDatabaseId, databseConnection, timeout))
+	logDebug(fmt.Sprintf("Using envId=%q, gcpProjectId=%q, spannerInstanceId=%q, spannerDatabaseId=%q, databseConnection=%q, tokenFile=%q, timeout=%d", envId, gcpProjectId, spannerInstanceId, spannerDatabaseId, databseConnection, tokenFile, timeout))
 
-	workingDir, err := os.Getwd()
-	if err != nil {
-		logFatal(fmt.Sprintf("Failed determining working directory: %v", err))
+	environments := loadEnvironments(config)
+	if err := environments.checkEnvironment(envId); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed checking command line argument `env_id`: %v", err))
+	}
+
+	if outOfOrder && !useHistory {
+		logFatal(errConfiguration, "Command line argument `out_of_order` requires `history`, since only the migration history tracks which older revisions were applied")
+	}
+	if err := config.checkPolicies(envId, environments); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed checking policies: %v", err))
 	}
-	logDebug(fmt.Sprintf("Determined working directory %q", workingDir))
+
+	streams := migrationStreams(workingDir, config)
 
 	logInfo("Beginning migration")
 
-	ddl, dml := determineMigrations(workingDir)
+	runHooks.run(ctx, hookBeforeRun, hookEnv{})
+
+	spannerClient, spannerAdminClient := newSpannerClient(ctx, databseConnection)
+	defer spannerClient.Close()
+	defer spannerAdminClient.Close()
+
+	detectDialect(ctx, spannerAdminClient, databseConnection)
+
+	for _, v := range streams {
+		setStream(v.Name)
+		if v.Name != "" {
+			logInfo(fmt.Sprintf("Migrating stream %q from directory %q", v.Name, v.Dir))
+		}
+		upStream(ctx, spannerClient, spannerAdminClient, v.Dir, environments)
+		applyRepeatableMigrations(ctx, spannerClient, spannerAdminClient, v.Dir)
+	}
+
+	logInfo("Finished migration")
+}
+
+// upStream applies the outstanding migrations of a stream
+func upStream(ctx context.Context, spannerClient *spanner.Client, spannerAdminClient *database.DatabaseAdminClient, workingDir string, environments *environments) {
+	databseConnection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
+
+	ddl, dml := determineMigrations(workingDir, environments)
 
 	if len(ddl) == 0 && len(dml) == 0 {
 		logInfo(fmt.Sprintf("No migrations found"))
 		return
 	}
 
-	if len(dml) == 0 {
-		logInfo(fmt.Sprintf("No DML migrations found, will apply all DDL migrations..."))
-		applyAllDdlMigrations(workingDir)
+	if useHistory {
+		upStreamWithHistory(ctx, spannerClient, spannerAdminClient, workingDir, ddl, dml)
 		return
 	}
 
-	logInfo("DDL and DML migrations found, will determine if any are outstanding...")
+	// Applying all DDL migrations at once with 'migrate up' cannot run hooks around each migration, and 'migrate' cannot
+	// apply DDL migrations to PostgreSQL-dialect databases at all
+	perMigrationDdl := runHooks.has(hookBeforeMigration) || runHooks.has(hookAfterMigration) || isPostgresql()
 
-	spannerClient, spannerAdminClient := newSpannerClient(ctx, databseConnection)
-	defer spannerClient.Close()
-	defer spannerAdminClient.Close()
-	cleanUpAndExitOnInterrupt([]Closable{spannerClient})
+	logInfo("Migrations found, will determine if any are outstanding...")
 
 	logInfo(fmt.Sprintf("Determining last DDL migration..."))
-	createMigrationTableIfNecessary(ctx, spannerAdminClient, databseConnection, "SchemaMigrations")
-	dirty, lastDdlMigration := determineLastMigration(ctx, spannerClient, "SchemaMigrations")
+	createMigrationTableIfNecessary(ctx, spannerAdminClient, databseConnection, schemaMigrationsTable)
+	dirty, lastDdlMigration := determineLastMigration(ctx, spannerClient, schemaMigrationsTable)
 	if dirty {
-		logFatal(fmt.Sprintf("SchemaMigrations table is dirty, this must be manually fixed before more migrations can be applied"))
+		logFatal(errDirtyState, fmt.Sprintf("%s table is dirty, this must be manually fixed before more migrations can be applied", schemaMigrationsTable))
 	}
 
-	logInfo(fmt.Sprintf("Determining last DML migration..."))
-	createMigrationTableIfNecessary(ctx, spannerAdminClient, databseConnection, "DataMigrations")
-	dirty, lastDmlMigration := determineLastMigration(ctx, spannerClient, "DataMigrations")
-	if dirty {
-		logFatal(fmt.Sprintf("DataMigrations table is dirty, this must be manually fixed before more migrations can be applied"))
+	// Without DML migrations DataMigrations is only needed if it already exists, to check it is consistent
+	var lastDmlMigration int64
+	if len(dml) > 0 || tableExists(ctx, spannerClient, dataMigrationsTable) {
+		logInfo(fmt.Sprintf("Determining last DML migration..."))
+		createMigrationTableIfNecessary(ctx, spannerAdminClient, databseConnection, dataMigrationsTable)
+		dirty, lastDmlMigration = determineLastMigration(ctx, spannerClient, dataMigrationsTable)
+		if dirty {
+			logFatal(errDirtyState, fmt.Sprintf("%s table is dirty, this must be manually fixed before more migrations can be applied", dataMigrationsTable))
+		}
 	}
 
+	report.versions(lastDdlMigration, lastDmlMigration)
+
 	outstandingDdlMigrations, outstandingDmlMigrations := outstandingMigrations(ddl, dml, lastDdlMigration, lastDmlMigration)
 
 	if len(outstandingDdlMigrations)+len(outstandingDmlMigrations) == 0 {
@@ -140,17 +442,57 @@ func main() {
 		return
 	}
 
-	if len(outstandingDmlMigrations) == 0 {
+	if len(outstandingDmlMigrations) == 0 && !perMigrationDdl {
 		logInfo(fmt.Sprintf("No outstanding DML migrations found, will apply all DDL migrations..."))
-		applyAllDdlMigrations(workingDir)
+		applyOutstandingDdlMigrations(ctx, spannerClient, workingDir, outstandingDdlMigrations)
 		return
 	}
 
-	logInfo("Outstanding DDL and DML migrations found, will apply all interleaved...")
+	logInfo("Outstanding migrations found, will apply all interleaved...")
+
+	applyAllMigrations(ctx, spannerClient, spannerAdminClient, workingDir, lastDmlMigration, outstandingDdlMigrations, outstandingDmlMigrations)
+}
 
-	applyAllMigrations(ctx, spannerClient, workingDir, lastDmlMigration, outstandingDdlMigrations, outstandingDmlMigrations)
+// upStreamWithHistory applies the outstanding migrations of a stream tracked in the migration history, one at a time
+// since 'migrate' only tracks DDL migrations in SchemaMigrations
+func upStreamWithHistory(ctx context.Context, spannerClient *spanner.Client, spannerAdminClient *database.DatabaseAdminClient, workingDir string, ddl, dml []string) {
+	databseConnection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
 
-	logInfo("Finished migration")
+	createMigrationTableIfNecessary(ctx, spannerAdminClient, databseConnection, migrationHistoryTable)
+	history := readMigrationHistory(ctx, spannerClient)
+	if len(history) == 0 {
+		history = convertLegacyMigrations(ctx, spannerClient, ddl, dml)
+	}
+
+	var lastDdlMigration, lastDmlMigration int64
+	for _, v := range history {
+		if v.kind == "ddl" {
+			lastDdlMigration = v.revision
+		} else {
+			lastDmlMigration = v.revision
+		}
+	}
+	report.versions(lastDdlMigration, lastDmlMigration)
+
+	outstanding, outOfOrderMigrations := outstandingHistoryMigrations(append(append([]string(nil), ddl...), dml...), history)
+	if len(outstanding) == 0 {
+		logInfo(fmt.Sprintf("No outstanding migrations found"))
+		return
+	}
+	report.outOfOrder(outOfOrderMigrations)
+
+	var outstandingDdlMigrations, outstandingDmlMigrations []string
+	for _, v := range outstanding {
+		if migrationKind(v) == "ddl" {
+			outstandingDdlMigrations = append(outstandingDdlMigrations, v)
+		} else {
+			outstandingDmlMigrations = append(outstandingDmlMigrations, v)
+		}
+	}
+
+	logInfo("Outstanding migrations found, will apply all interleaved...")
+
+	applyAllMigrations(ctx, spannerClient, spannerAdminClient, workingDir, lastDmlMigration, outstandingDdlMigrations, outstandingDmlMigrations)
 }
 
 func checkArgs() error {
@@ -169,69 +511,214 @@ func checkArgs() error {
 	return nil
 }
 
-func determineMigrations(dir string) (ddl []string, dml []string) {
+func determineMigrations(dir string, environments *environments) (ddl []string, dml []string) {
 	logInfo(fmt.Sprintf("Determining migrations..."))
 
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		logFatal(fmt.Sprintf("Failed reading files in directory %q: %v", dir, err))
+		logFatal(errDiscovery, fmt.Sprintf("Failed reading files in directory %q: %v", dir, err))
 	}
 
 	if len(files) == 0 {
 		logDebug(fmt.Sprintf("Found no files in directory %q", dir))
 	}
 
+	dmlRevisions := make(map[int64]string)
+	assertionRevisions := make(map[int64][]string)
+
 	for _, v := range files {
 		logDebug(fmt.Sprintf("Found file %q", v.Name()))
 
 		if strings.HasSuffix(v.Name(), ".ddl.up.sql") {
 			ddl = append(ddl, v.Name())
 
-		} else if strings.HasSuffix(v.Name(), ".all.dml.sql") {
-			dml = append(dml, v.Name())
+		} else if strings.HasSuffix(v.Name(), ".dml.sql") {
+			selector := dmlMigrationSelector(dir, v.Name(), environments)
+			if !selector.matches(envId) {
+				logDebug(fmt.Sprintf("Skipping DML migration %q since its environment selector does not match env %q", v.Name(), envId))
+				continue
+			}
 
-		} else if strings.HasSuffix(v.Name(), fmt.Sprintf(".%s.dml.sql", envId)) {
-			dml = append(dml, v.Name())
+			version, err := migrationVersion(v.Name())
+			if err != nil {
+				logFatal(errDiscovery, fmt.Sprintf("Failed determining DML migration version from file name %q: %v", v.Name(), err))
+			}
+			if other, ok := dmlRevisions[version]; ok {
+				logFatal(errDiscovery, fmt.Sprintf("Found DML migrations %q and %q with the same revision '%d' for env %q, there can only be one DML migration for a revision for each environment", other, v.Name(), version, envId))
+			}
+			dmlRevisions[version] = v.Name()
 
-		} else if strings.HasSuffix(v.Name(), ".dml.sql") && strings.Contains(v.Name(), fmt.Sprintf(".%s.", envId)) {
 			dml = append(dml, v.Name())
+
+		} else if strings.HasSuffix(v.Name(), ".verify.sql") {
+			selector := migrationSelector(dir, v.Name(), ".verify.sql", "Assertion file", environments)
+			if !selector.matches(envId) {
+				logDebug(fmt.Sprintf("Skipping assertion file %q since its environment selector does not match env %q", v.Name(), envId))
+				continue
+			}
+
+			version, err := migrationVersion(v.Name())
+			if err != nil {
+				logFatal(errDiscovery, fmt.Sprintf("Failed determining assertion file version from file name %q: %v", v.Name(), err))
+			}
+			assertionRevisions[version] = append(assertionRevisions[version], v.Name())
 		}
 	}
 
+	dmlAssertions = make(map[string][]string)
+	for version, v := range assertionRevisions {
+		migration, ok := dmlRevisions[version]
+		if !ok {
+			logFatal(errDiscovery, fmt.Sprintf("Found assertion files %v for revision '%d' but no DML migration of that revision for env %q", v, version, envId))
+		}
+		dmlAssertions[migration] = v
+		logInfo(fmt.Sprintf("Found '%d' assertion files for DML migration %q: %v", len(v), migration, v))
+	}
+
 	logInfo(fmt.Sprintf("Found '%d' DDL migrations: %v", len(ddl), ddl))
 	logInfo(fmt.Sprintf("Found '%d' DML migrations: %v", len(dml), dml))
 
 	return
 }
 
-func applyAllDdlMigrations(dir string) {
-	cmd := exec.Command("migrate", "-path", dir, "-database", fmt.Sprintf("spanner://projects/%s/instances/%s/databases/%s?x-clean-statements=true", gcpProjectId, spannerInstanceId, spannerDatabaseId), "up")
-	var outb, errb bytes.Buffer
-	cmd.Stdout = &outb
-	cmd.Stderr = &errb
+// dmlMigrationSelector determines which environments a DML migration applies to, either from the environment segments
+// of its file name, e.g. '004_foo_load.+dev+uat.dml.sql', or from an `env` directive in its header, e.g.
+// '-- migratex: env=!prod', but not both
+func dmlMigrationSelector(dir, migration string, environments *environments) *envSelector {
+	return migrationSelector(dir, migration, ".dml.sql", "DML migration", environments)
+}
 
-	logInfo(fmt.Sprintf("Applying all DDL migrations: %v", cmd.Args))
-	if err := cmd.Run(); err != nil {
-		logFatal(fmt.Sprintf("Failed applying all DDL migrations Stdout=%q, Stderr=%q: %v", outb.String(), errb.String(), err))
+// migrationSelector determines the environment selector of a per environment file, such as a DML migration or an
+// assertion file, from its header or the environment segments of its file name before the suffix
+func migrationSelector(dir, migration, suffix, description string, environments *environments) *envSelector {
+	f := fmt.Sprintf("%s/%s", dir, migration)
+	fileBytes, err := ioutil.ReadFile(f)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed reading %s file %q: %v", description, f, err))
+	}
+	directives, _, err := parseMigrationDirectives(string(fileBytes))
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed parsing directives in %s file %q: %v", description, f, err))
+	}
+
+	segments := strings.Split(strings.TrimSuffix(migration, suffix), ".")[1:]
+
+	var selector string
+	legacy := false
+	if headerSelector, ok := directives["env"]; ok {
+		if len(segments) > 0 {
+			logFatal(errDiscovery, fmt.Sprintf("%s %q has environments in both its file name and its header, only one is allowed", description, migration))
+		}
+		selector = headerSelector
+	} else if len(segments) > 0 {
+		// Legacy file names list environments as separate segments, e.g. '004_foo_load.dev.uat.dml.sql'
+		selector = strings.Join(segments, "+")
+		legacy = true
+		for _, v := range segments {
+			legacy = legacy && isEnvName(v)
+		}
+	} else {
+		logFatal(errDiscovery, fmt.Sprintf("%s %q has no environments in its file name or its header", description, migration))
+	}
+
+	// A misspelt environment or group in a selector would otherwise silently select no environment
+	if !legacy && !environments.declared() {
+		logFatal(errDiscovery, fmt.Sprintf("%s %q has environment selector %q, which requires environments declared in the config file", description, migration, selector))
+	}
+
+	s, err := parseEnvSelector(selector, environments)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed parsing environment selector %q of %s %q: %v", selector, description, migration, err))
 	}
-	logInfo(fmt.Sprintf("Finished applying all DDL migrations Stdout=%q, Stderr=%q", outb.String(), errb.String()))
+	logDebug(fmt.Sprintf("%s %q has environment selector %q", description, migration, selector))
+	return s
 }
 
-func applyNextDdlMigration(dir string) {
-	cmd := exec.Command("migrate", "-path", dir, "-database", fmt.Sprintf("spanner://projects/%s/instances/%s/databases/%s?x-clean-statements=true", gcpProjectId, spannerInstanceId, spannerDatabaseId), "up", "1")
+func applyAllDdlMigrations(ctx context.Context, dir string) {
+	runMigrate(ctx, "all DDL migrations", "-path", dir, "-database", fmt.Sprintf("spanner://projects/%s/instances/%s/databases/%s?x-clean-statements=true&x-migrations-table=%s", gcpProjectId, spannerInstanceId, spannerDatabaseId, schemaMigrationsTable), "up")
+}
+
+// applyOutstandingDdlMigrations applies the outstanding DDL migrations at once with 'migrate up', reporting each of
+// them. When 'migrate' fails the version it reached tells which of them were applied.
+func applyOutstandingDdlMigrations(ctx context.Context, spannerClient *spanner.Client, dir string, outstanding []string) {
+	report.pending(outstanding)
+	report.startedAll(outstanding)
+
+	if r := catchFatal(func() { applyAllDdlMigrations(ctx, dir) }); r != nil {
+		// The context of the run may have been cancelled or timed out
+		readCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if failure := catchFatal(func() {
+			dirty, version := determineLastMigration(readCtx, spannerClient, schemaMigrationsTable)
+			report.reachedAll(version, dirty)
+		}); failure != nil {
+			logWarn(fmt.Sprintf("Failed determining which DDL migrations were applied for the report: %v", failure))
+		}
+		panic(r)
+	}
+	report.succeeded()
+}
+
+func applyNextDdlMigration(ctx context.Context, dir string) {
+	runMigrate(ctx, "next DDL migration", "-path", dir, "-database", fmt.Sprintf("spanner://projects/%s/instances/%s/databases/%s?x-clean-statements=true&x-migrations-table=%s", gcpProjectId, spannerInstanceId, spannerDatabaseId, schemaMigrationsTable), "up", "1")
+}
+
+// runMigrate runs 'migrate' to apply DDL migrations. When interrupted 'migrate' is left to finish unless the
+// `interrupt_ddl` command line argument is set, in which case the interrupt is passed on to it.
+func runMigrate(ctx context.Context, description string, args ...string) {
+	_, span := startSpan(ctx, "migrate", attribute.String("migratex.description", description))
+	defer endSpan(span)
+
+	cmd := exec.Command("migrate", args...)
+	if interruptDdl {
+		cmd = exec.CommandContext(ctx, "migrate", args...)
+		cmd.Cancel = func() error {
+			return cmd.Process.Signal(os.Interrupt)
+		}
+	}
 	var outb, errb bytes.Buffer
 	cmd.Stdout = &outb
 	cmd.Stderr = &errb
 
-	logInfo(fmt.Sprintf("Applying next DDL migration: %v", cmd.Args))
+	logInfo(fmt.Sprintf("Applying %s: %v", description, cmd.Args))
 	if err := cmd.Run(); err != nil {
-		logFatal(fmt.Sprintf("Failed applying next DDL migration Stdout=%q, Stderr=%q: %v", outb.String(), errb.String(), err))
+		logFatal(migrateErrorCategory(ctx, errb.String()), fmt.Sprintf("Failed applying %s Stdout=%q, Stderr=%q: %v", description, outb.String(), errb.String(), err))
+	}
+	logInfo(fmt.Sprintf("Finished applying %s Stdout=%q, Stderr=%q", description, outb.String(), errb.String()))
+}
+
+// migrateErrorCategory categorizes a failure of 'migrate' from its stderr, which is the only place it reports that
+// SchemaMigrations is dirty
+func migrateErrorCategory(ctx context.Context, stderr string) errorCategory {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return errInterrupted
+	}
+	if strings.Contains(stderr, "Dirty database version") {
+		return errDirtyState
 	}
-	logInfo(fmt.Sprintf("Finished applying next DDL migration Stdout=%q, Stderr=%q", outb.String(), errb.String()))
+	if strings.Contains(stderr, "can't acquire lock") {
+		return errLockContention
+	}
+	return errDdl
+}
+
+// ddlContext returns a context for waiting on DDL operations, which are not cancelled when interrupted unless the
+// `interrupt_ddl` command line argument is set since the operation carries on regardless of the client giving up
+func ddlContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if interruptDdl {
+		return context.WithCancel(ctx)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(context.WithoutCancel(ctx), deadline)
+	}
+	return context.WithCancel(context.WithoutCancel(ctx))
 }
 
 func determineLastMigration(ctx context.Context, spannerClient *spanner.Client, migrationTableName string) (bool, int64) {
-	stmt := spanner.Statement{SQL: fmt.Sprintf("SELECT Dirty, Version FROM %s ORDER BY Version DESC LIMIT 1", migrationTableName)}
+	ctx, span := startSpan(ctx, "determineLastMigration", attribute.String("migratex.table", migrationTableName))
+	defer endSpan(span)
+
+	stmt := dialectStatement(fmt.Sprintf("SELECT Dirty, Version FROM %s ORDER BY Version DESC LIMIT 1", migrationTableName))
 	iter := spannerClient.Single().Query(ctx, stmt)
 	defer iter.Stop()
 	for {
@@ -241,12 +728,12 @@ func determineLastMigration(ctx context.Context, spannerClient *spanner.Client,
 			return false, 0
 		}
 		if err != nil {
-			logFatal(fmt.Sprintf("Failed determining last migration in table %q: %v", migrationTableName, err))
+			logFatal(spannerErrorCategory(err, errUnexpected), fmt.Sprintf("Failed determining last migration in table %q: %v", migrationTableName, err))
 		}
 		var dirty bool
 		var version int64
 		if err := row.Columns(&dirty, &version); err != nil {
-			logFatal(fmt.Sprintf("Failed determining last migration in table %q, could not unpack columns: %v", migrationTableName, err))
+			logFatal(errUnexpected, fmt.Sprintf("Failed determining last migration in table %q, could not unpack columns: %v", migrationTableName, err))
 		}
 		logInfo(fmt.Sprintf("Last migration in table %q: '%d'", migrationTableName, version))
 		return dirty, version
@@ -257,28 +744,30 @@ func outstandingMigrations(availableDdlMigrations, availableDmlMigrations []stri
 	logInfo(fmt.Sprintf("Determining outstanding DDL and DML migrations..."))
 
 	for _, v := range availableDdlMigrations {
-		if version, err := strconv.ParseInt(strings.Split(v, "_")[0], 10, 64); err == nil {
+		if version, err := migrationVersion(v); err == nil {
 			if version > lastDdlMigration {
-				if version < lastDmlMigration {
-					logFatal(fmt.Sprintf("Found inconsistent migration state. Outstanding DDL migration %q should have already been applied since it comes before the current DML migration version '%d'", v, lastDmlMigration))
+				// A DDL migration is applied before a DML migration of the same revision (see sortMigrations) so it must
+				// already have been applied if the DML migration of the same revision has been
+				if version <= lastDmlMigration {
+					logFatal(errInconsistentState, fmt.Sprintf("Found inconsistent migration state. Outstanding DDL migration %q should have already been applied since it comes before the current DML migration version '%d'", v, lastDmlMigration))
 				}
 				ddl = append(ddl, v)
 			}
 		} else {
-			logFatal(fmt.Sprintf("Failed determining DDL migration version from file name %q: %v", v, err))
+			logFatal(errDiscovery, fmt.Sprintf("Failed determining DDL migration version from file name %q: %v", v, err))
 		}
 	}
 
 	for _, v := range availableDmlMigrations {
-		if version, err := strconv.ParseInt(strings.Split(v, "_")[0], 10, 64); err == nil {
+		if version, err := migrationVersion(v); err == nil {
 			if version > lastDmlMigration {
 				if version < lastDdlMigration {
-					logFatal(fmt.Sprintf("Found inconsistent migration state. Outstanding DML migration %q should have already been applied since it comes before the current DDL migration version '%d'", v, lastDdlMigration))
+					logFatal(errInconsistentState, fmt.Sprintf("Found inconsistent migration state. Outstanding DML migration %q should have already been applied since it comes before the current DDL migration version '%d'", v, lastDdlMigration))
 				}
 				dml = append(dml, v)
 			}
 		} else {
-			logFatal(fmt.Sprintf("Failed determining DML migration version from file name %q: %v", v, err))
+			logFatal(errDiscovery, fmt.Sprintf("Failed determining DML migration version from file name %q: %v", v, err))
 		}
 	}
 
@@ -291,81 +780,165 @@ func outstandingMigrations(availableDdlMigrations, availableDmlMigrations []stri
 func createMigrationTableIfNecessary(ctx context.Context, spannerAdminClient *database.DatabaseAdminClient, databseConnection, migrationTableName string) {
 	logInfo(fmt.Sprintf("Creating table %q if necessary...", migrationTableName))
 
+	ctx, span := startSpan(ctx, "createMigrationTable", attribute.String("migratex.table", migrationTableName))
+	defer endSpan(span)
+
+	ctx, cancel := ddlContext(ctx)
+	defer cancel()
+
 	op, err := spannerAdminClient.UpdateDatabaseDdl(ctx, &adminpb.UpdateDatabaseDdlRequest{
 		Database: databseConnection,
 		Statements: []string{
-			fmt.Sprintf("CREATE TABLE %s (Version INT64 NOT NULL, Dirty BOOL NOT NULL) PRIMARY KEY (Version)", migrationTableName),
+			migrationTableDdl(migrationTableName),
 		},
 	})
 	if err != nil {
-		logFatal(fmt.Sprintf("Failed creating the %q table: %v", migrationTableName, err))
+		logFatal(spannerErrorCategory(err, errDdl), fmt.Sprintf("Failed creating the %q table: %v", migrationTableName, err))
 	}
 	if err := op.Wait(ctx); err != nil {
 		logDebug(fmt.Sprintf("DDL request returned code=%q, desc=%q", grpc.Code(err), grpc.ErrorDesc(err)))
-		if grpc.Code(err) == codes.FailedPrecondition && strings.Contains(grpc.ErrorDesc(err), "Duplicate name in schema") && strings.Contains(grpc.ErrorDesc(err), migrationTableName) {
+		if isDuplicateNameError(err, migrationTableName) {
 			logDebug(fmt.Sprintf("%q table already exists", migrationTableName))
 			return
 		}
-		logFatal(fmt.Sprintf("Failed creating the %q table after waiting: %v", migrationTableName, err))
+		logFatal(spannerErrorCategory(err, errDdl), fmt.Sprintf("Failed creating the %q table after waiting: %v", migrationTableName, err))
 	}
 }
 
-func applyAllMigrations(ctx context.Context, spannerClient *spanner.Client, dir string, currentDmlMigrationVersion int64, outstandingDdlMigrations, outstandingDmlMigrations []string) {
+// isDuplicateNameError returns whether creating a table failed because it already exists, where PostgreSQL-dialect
+// databases name the table in lower case
+func isDuplicateNameError(err error, table string) bool {
+	desc := grpc.ErrorDesc(err)
+	return grpc.Code(err) == codes.FailedPrecondition && strings.Contains(desc, "Duplicate name in schema") && strings.Contains(strings.ToLower(desc), strings.ToLower(table))
+}
+
+func applyAllMigrations(ctx context.Context, spannerClient *spanner.Client, spannerAdminClient *database.DatabaseAdminClient, dir string, currentDmlMigrationVersion int64, outstandingDdlMigrations, outstandingDmlMigrations []string) {
 	logInfo(fmt.Sprintf("Applying all migrations..."))
 
-	outstandingMigrations := append(outstandingDdlMigrations, outstandingDmlMigrations...)
-	sort.Strings(outstandingMigrations)
+	outstandingMigrations := make([]string, 0, len(outstandingDdlMigrations)+len(outstandingDmlMigrations))
+	outstandingMigrations = append(outstandingMigrations, outstandingDdlMigrations...)
+	outstandingMigrations = append(outstandingMigrations, outstandingDmlMigrations...)
+	sortMigrations(outstandingMigrations)
 
 	logInfo(fmt.Sprintf("Applying '%d' outstanding migrations: %v", len(outstandingMigrations), outstandingMigrations))
 
+	defer setLogRevision(0)
+
+	report.pending(outstandingMigrations)
+
+	applied := 0
+	defer func() {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			logWarn(fmt.Sprintf("Interrupted after applying '%d' of '%d' outstanding migrations. Applied: %v. Not applied: %v", applied, len(outstandingMigrations), outstandingMigrations[:applied], outstandingMigrations[applied:]))
+		}
+	}()
+
 	for _, v := range outstandingMigrations {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			logFatal(errInterrupted, fmt.Sprintf("Interrupted before applying migration %q", v))
+		}
+
+		if version, err := migrationVersion(v); err == nil {
+			setLogRevision(version)
+		}
 		logDebug(fmt.Sprintf("Applying outstanding migration %q where current DML migration version is '%d'", v, currentDmlMigrationVersion))
 
-		if strings.HasSuffix(v, ".ddl.up.sql") {
-			applyNextDdlMigration(dir)
+		migrationHookEnv := hookEnv{migration: v}
+		runHooks.run(ctx, hookBeforeMigration, migrationHookEnv)
 
-		} else if strings.HasSuffix(v, ".all.dml.sql") {
-			currentDmlMigrationVersion = applyDmlMigration(ctx, spannerClient, dir, currentDmlMigrationVersion, v)
+		report.started(v)
+		func() {
+			ctx, span := startMigrationSpan(ctx, v)
+			defer endMigrationSpan(span, v, time.Now())
 
-		} else if strings.HasSuffix(v, fmt.Sprintf(".%s.dml.sql", envId)) {
-			currentDmlMigrationVersion = applyDmlMigration(ctx, spannerClient, dir, currentDmlMigrationVersion, v)
+			if strings.HasSuffix(v, ".ddl.up.sql") && (isPostgresql() || useHistory) {
+				applyDdlMigrationDirectly(ctx, spannerClient, spannerAdminClient, dir, v)
 
-		} else if strings.HasSuffix(v, ".dml.sql") && strings.Contains(v, fmt.Sprintf(".%s.", envId)) {
-			currentDmlMigrationVersion = applyDmlMigration(ctx, spannerClient, dir, currentDmlMigrationVersion, v)
-		}
+			} else if strings.HasSuffix(v, ".ddl.up.sql") {
+				applyNextDdlMigration(ctx, dir)
+
+			} else if strings.HasSuffix(v, ".dml.sql") {
+				currentDmlMigrationVersion = applyDmlMigration(ctx, spannerClient, dir, currentDmlMigrationVersion, v)
+			}
+		}()
+		report.succeeded()
+		applied++
+
+		runHooks.run(ctx, hookAfterMigration, migrationHookEnv)
 	}
 }
 
+// sortMigrations orders migrations by their numeric revision, so '10_x' is applied after '9_y' regardless of zero
+// padding. When a DDL and a DML migration share a revision the DDL migration is applied first, which is the order
+// outstandingMigrations assumes when checking the DDL and DML migration versions are consistent. Migrations that
+// still compare equal keep their file name order.
+func sortMigrations(migrations []string) {
+	sort.SliceStable(migrations, func(i, j int) bool {
+		vi, erri := migrationVersion(migrations[i])
+		if erri != nil {
+			logFatal(errDiscovery, fmt.Sprintf("Failed determining migration version from file name %q: %v", migrations[i], erri))
+		}
+		vj, errj := migrationVersion(migrations[j])
+		if errj != nil {
+			logFatal(errDiscovery, fmt.Sprintf("Failed determining migration version from file name %q: %v", migrations[j], errj))
+		}
+		if vi != vj {
+			return vi < vj
+		}
+		ddli := strings.HasSuffix(migrations[i], ".ddl.up.sql")
+		ddlj := strings.HasSuffix(migrations[j], ".ddl.up.sql")
+		if ddli != ddlj {
+			return ddli
+		}
+		return migrations[i] < migrations[j]
+	})
+}
+
+// migrationVersion parses the revision prefix of a migration file name, e.g. '007' of '007_foo_load.all.dml.sql'
+func migrationVersion(migration string) (int64, error) {
+	return strconv.ParseInt(strings.Split(migration, "_")[0], 10, 64)
+}
+
 func applyDmlMigration(ctx context.Context, spannerClient *spanner.Client, dir string, currentDmlMigrationVersion int64, migration string) int64 {
 	logInfo(fmt.Sprintf("Appyling next DML migration %q from directory %q", migration, dir))
 
 	var nextDmlMigrationVersion int64
 	var err error
-	if nextDmlMigrationVersion, err = strconv.ParseInt(strings.Split(migration, "_")[0], 10, 64); err != nil {
-		logFatal(fmt.Sprintf("Failed determining next DML migration version from file name %q: %v", migration, err))
+	if nextDmlMigrationVersion, err = migrationVersion(migration); err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed determining next DML migration version from file name %q: %v", migration, err))
 	}
 
 	f := fmt.Sprintf("%s/%s", dir, migration)
 	fileBytes, err := ioutil.ReadFile(f)
 	if err != nil {
-		logFatal(fmt.Sprintf("Failed reading DML migration file %q: %v", f, err))
+		logFatal(errDiscovery, fmt.Sprintf("Failed reading DML migration file %q: %v", f, err))
+	}
+	directives, migrationFileString, err := parseMigrationDirectives(string(fileBytes))
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed parsing directives in DML migration file %q: %v", f, err))
+	}
+	options, err := parseMigrationOptions(directives)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed parsing directives in DML migration file %q: %v", f, err))
+	}
+	if options.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.timeout)
+		defer cancel()
 	}
-	migrationFileString := string(fileBytes)
 
 	migrationData := make(map[string]string)
 
+	if tokenFile != "" {
+		readMigrationData(tokenFile, migrationData)
+	}
+
 	tf := fmt.Sprintf("%s/%s", dir, strings.TrimSuffix(migration, ".sql")+".json")
 	if _, err := os.Stat(tf); os.IsNotExist(err) {
 		logDebug(fmt.Sprintf("No migration data file %q for DML migration file %q", tf, f))
 
 	} else {
-		fileBytes, err := ioutil.ReadFile(tf)
-		if err != nil {
-			logFatal(fmt.Sprintf("Failed reading DML migration data file %q: %v", tf, err))
-		}
-		if err := json.Unmarshal(fileBytes, &migrationData); err != nil {
-			logFatal(fmt.Sprintf("Failed unpacking DML migration data file %q into json: %v", tf, err))
-		}
+		readMigrationData(tf, migrationData)
 	}
 
 	if len(migrationData) > 0 {
@@ -374,205 +947,4315 @@ func applyDmlMigration(ctx context.Context, spannerClient *spanner.Client, dir s
 		}
 	}
 
-	setDataMigrationsDirty(ctx, spannerClient, nextDmlMigrationVersion)
+	var assertions []assertion
+	for _, v := range dmlAssertions[migration] {
+		assertions = append(assertions, readAssertions(dir, v, migrationData)...)
+	}
+
+	split, err := splitStatements(migrationFileString)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed splitting DML migration file %q into statements: %v", f, err))
+	}
 
 	var statements []spanner.Statement
-	for _, v := range strings.Split(migrationFileString, ";") {
-		v = replaceWhiteSpaceWithSpace(strings.TrimSpace(v)) + ";"
-		if v != ";" {
-			statements = append(statements, spanner.Statement{SQL: v})
-			logDebug(fmt.Sprintf("-> Created statement from SQL %q", v))
-		}
-	}
-	statements = append(statements, spanner.Statement{
-		SQL: "UPDATE DataMigrations	SET Dirty=@dirty WHERE Version=@version",
-		Params: map[string]interface{}{
-			"dirty":   false,
-			"version": nextDmlMigrationVersion,
-		},
-	})
+	var expectations []*expectation
+	for _, v := range split {
+		if v.expect != nil && !v.expect.rows {
+			logFatal(errDiscovery, fmt.Sprintf("Invalid expectation %s of statement %q in DML migration file %q, only row counts can be expected of DML statements", v.expect, v.sql, f))
+		}
+		if v.expect != nil && options.transaction == transactionPartitioned {
+			logFatal(errDiscovery, fmt.Sprintf("Invalid expectation %s of statement %q in DML migration file %q, partitioned DML only returns a lower bound of the row count", v.expect, v.sql, f))
+		}
+		if isDestructiveStatement(v.sql) && !options.allowDestructive {
+			logFatal(errDiscovery, fmt.Sprintf("Statement %q in DML migration file %q changes every row of its table, add the directive `%s allow_destructive=true` if this is intended", v.sql, f, migrationDirectivePrefix))
+		}
+		statements = append(statements, spanner.Statement{SQL: v.sql + ";"})
+		expectations = append(expectations, v.expect)
+		logDebug(fmt.Sprintf("-> Created statement from SQL %q", redact(v.sql+";")))
+	}
+	migrationStatementCount := len(statements)
+
+	if useHistory {
+		insertDirtyMigration(ctx, spannerClient, migration)
+		statements = append(statements, appliedMigrationStatement(migration))
 
-	if currentDmlMigrationVersion > 0 {
-		logInfo(fmt.Sprintf("Prior DML migration version '%d' will be deleted from DML migration tracking table 'DataMigrations'", currentDmlMigrationVersion))
-		statements = append(statements, spanner.Statement{
-			SQL: "DELETE FROM DataMigrations WHERE Version=@version",
-			Params: map[string]interface{}{
-				"version": currentDmlMigrationVersion,
-			},
-		})
 	} else {
-		logInfo("No prior DML migration versions need to be deleted from DML migration tracking table 'DataMigrations'")
+		setDataMigrationsDirty(ctx, spannerClient, nextDmlMigrationVersion)
+
+		statements = append(statements, dialectStatement(fmt.Sprintf("UPDATE %s	SET Dirty=@dirty WHERE Version=@version", dataMigrationsTable), "dirty", false, "version", nextDmlMigrationVersion))
+
+		if currentDmlMigrationVersion > 0 {
+			logInfo(fmt.Sprintf("Prior DML migration version '%d' will be deleted from DML migration tracking table %q", currentDmlMigrationVersion, dataMigrationsTable))
+			statements = append(statements, dialectStatement(fmt.Sprintf("DELETE FROM %s WHERE Version=@version", dataMigrationsTable), "version", currentDmlMigrationVersion))
+		} else {
+			logInfo(fmt.Sprintf("No prior DML migration versions need to be deleted from DML migration tracking table %q", dataMigrationsTable))
+		}
+	}
+
+	check := func(ctx context.Context, txn *spanner.ReadWriteTransaction, queryOptions spanner.QueryOptions, rowCounts []int64) error {
+		if err := checkRowCounts(migration, statements, expectations, rowCounts); err != nil {
+			return err
+		}
+		return checkAssertions(ctx, txn, queryOptions, assertions)
 	}
 
-	applyDmlStatements(ctx, spannerClient, currentDmlMigrationVersion, nextDmlMigrationVersion, statements)
+	var rowCounts []int64
+	if options.transaction == transactionSingle {
+		rowCounts = applyDmlStatements(ctx, spannerClient, currentDmlMigrationVersion, nextDmlMigrationVersion, statements, options, check)
+	} else {
+		rowCounts = applyDmlStatementsIndividually(ctx, spannerClient, currentDmlMigrationVersion, nextDmlMigrationVersion, statements[:migrationStatementCount], statements[migrationStatementCount:], options, check)
+	}
+	if len(rowCounts) >= migrationStatementCount {
+		// Recorded on the span of the migration, excluding the statements updating the tracking tables
+		recordRowsAffected(ctx, rowCounts[:migrationStatementCount])
+		report.rowCounts(rowCounts[:migrationStatementCount])
+	}
 
 	return nextDmlMigrationVersion
 }
 
-func applyDmlStatements(ctx context.Context, spannerClient *spanner.Client, currentDmlMigrationVersion, nextDmlMigrationVersion int64, statements []spanner.Statement) {
+// readMigrationData reads the tokens in a JSON token definition file into migrationData, replacing any tokens of the
+// same name already read from another file
+func readMigrationData(tf string, migrationData map[string]string) {
+	fileBytes, err := ioutil.ReadFile(tf)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed reading DML migration data file %q: %v", tf, err))
+	}
+	data := make(map[string]string)
+	if err := json.Unmarshal(fileBytes, &data); err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed unpacking DML migration data file %q into json: %v", tf, err))
+	}
+	for k, v := range data {
+		if isSecretToken(k) {
+			addSecret(k, v)
+		}
+		migrationData[k] = v
+	}
+}
 
-	logInfo(fmt.Sprintf("Applying DML migrations from version '%d' to version '%d': %v", currentDmlMigrationVersion, nextDmlMigrationVersion, statements))
+// applyDmlStatements applies the statements in a single transaction, followed by the check of their row counts and
+// assertions which rolls the transaction back if it fails, returning the row count of each statement
+func applyDmlStatements(ctx context.Context, spannerClient *spanner.Client, currentDmlMigrationVersion, nextDmlMigrationVersion int64, statements []spanner.Statement, options migrationOptions, check dmlCheck) []int64 {
 
-	_, err := spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		rowCounts, err := txn.BatchUpdate(ctx, statements)
+	logInfo(fmt.Sprintf("Applying DML migrations from version '%d' to version '%d': %s", currentDmlMigrationVersion, nextDmlMigrationVersion, fmtStatements(statements)))
+
+	tag := fmt.Sprintf("migratex-dml-%d", nextDmlMigrationVersion)
+	ctx, span := startSpan(ctx, "batchUpdate", attribute.Int("migratex.statements", len(statements)), attribute.String("spanner.transaction_tag", tag), attribute.String("spanner.request_tag", tag))
+	defer endSpan(span)
+
+	queryOptions := spanner.QueryOptions{RequestTag: tag, Priority: options.priority}
+	var rowCounts []int64
+	// The client retries the transaction when it is aborted by a conflicting transaction
+	attempts := 0
+	_, err := spannerClient.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		attempts++
+		var err error
+		rowCounts, err = txn.BatchUpdateWithOptions(ctx, statements, queryOptions)
 		if err != nil {
 			return err
 		}
 		logInfo(fmt.Sprintf("Applied DML migrations from version '%d' to version '%d'. Updated row counts '%d'", currentDmlMigrationVersion, nextDmlMigrationVersion, rowCounts))
-		return nil
-	})
+		return check(ctx, txn, queryOptions, rowCounts)
+	}, spanner.TransactionOptions{TransactionTag: tag, CommitPriority: options.priority})
 	if err != nil {
-		logFatal(fmt.Sprintf("Failed applying DML migrations from version '%d' to version '%d': %v", currentDmlMigrationVersion, nextDmlMigrationVersion, err))
+		var failed *assertionError
+		if errors.As(err, &failed) {
+			// The transaction was rolled back so the migration can be retried once it is no longer marked as dirty
+			clearDataMigrationsDirty(spannerClient, nextDmlMigrationVersion)
+			logFatal(errAssertion, fmt.Sprintf("Failed expectation of DML migrations from version '%d' to version '%d', the transaction was rolled back: %v", currentDmlMigrationVersion, nextDmlMigrationVersion, failed))
+		}
+		if errors.Is(ctx.Err(), context.Canceled) {
+			// The transaction was rolled back so the migration can be retried once it is no longer marked as dirty
+			clearDataMigrationsDirty(spannerClient, nextDmlMigrationVersion)
+			logFatal(errInterrupted, fmt.Sprintf("Interrupted applying DML migrations from version '%d' to version '%d', the transaction was rolled back: %v", currentDmlMigrationVersion, nextDmlMigrationVersion, err))
+		}
+		logFatal(contentionErrorCategory(err, attempts > 1, errDml), fmt.Sprintf("Failed applying DML migrations from version '%d' to version '%d' after '%d' attempts: %v", currentDmlMigrationVersion, nextDmlMigrationVersion, attempts, err))
 	}
+	return rowCounts
 }
 
-func setDataMigrationsDirty(ctx context.Context, spannerClient *spanner.Client, version int64) {
-	logInfo(fmt.Sprintf("Inserting version '%d' in DataMigrations table as dirty", version))
+// dmlCheck checks the row counts and assertions of a DML migration in its transaction, failing with an assertionError
+// to roll it back
+type dmlCheck func(ctx context.Context, txn *spanner.ReadWriteTransaction, queryOptions spanner.QueryOptions, rowCounts []int64) error
 
-	_, err := spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		stmt := spanner.Statement{
-			SQL: "INSERT DataMigrations	(Dirty, Version) VALUES (@dirty, @version)",
-			Params: map[string]interface{}{
-				"dirty":   true,
-				"version": version,
-			},
+// applyDmlStatementsIndividually applies each statement of a DML migration on its own, in its own transaction or as
+// partitioned DML, followed by the statements updating DataMigrations and the check in a final transaction. Statements
+// already applied cannot be rolled back, so on failure the migration is left dirty.
+func applyDmlStatementsIndividually(ctx context.Context, spannerClient *spanner.Client, currentDmlMigrationVersion, nextDmlMigrationVersion int64, statements []spanner.Statement, trackingStatements []spanner.Statement, options migrationOptions, check dmlCheck) []int64 {
+	logInfo(fmt.Sprintf("Applying DML migrations from version '%d' to version '%d' with transaction=%s: %s", currentDmlMigrationVersion, nextDmlMigrationVersion, options.transaction, fmtStatements(statements)))
+
+	tag := fmt.Sprintf("migratex-dml-%d", nextDmlMigrationVersion)
+	ctx, span := startSpan(ctx, "applyIndividually", attribute.Int("migratex.statements", len(statements)), attribute.String("migratex.transaction", options.transaction), attribute.String("spanner.request_tag", tag))
+	defer endSpan(span)
+
+	queryOptions := spanner.QueryOptions{RequestTag: tag, Priority: options.priority}
+	transactionOptions := spanner.TransactionOptions{TransactionTag: tag, CommitPriority: options.priority}
+
+	var rowCounts []int64
+	for i, v := range statements {
+		var rowCount int64
+		var err error
+		if options.transaction == transactionPartitioned {
+			rowCount, err = spannerClient.PartitionedUpdateWithOptions(ctx, v, queryOptions)
+		} else {
+			_, err = spannerClient.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+				var err error
+				rowCount, err = txn.UpdateWithOptions(ctx, v, queryOptions)
+				return err
+			}, transactionOptions)
 		}
-		rowCount, err := txn.Update(ctx, stmt)
 		if err != nil {
+			logFatal(spannerErrorCategory(err, errDml), fmt.Sprintf("Failed applying statement '%d' of '%d' of DML migration version '%d', the statements before it were applied so %s is left dirty: %v", i+1, len(statements), nextDmlMigrationVersion, trackingTable("dml"), err))
+		}
+		logInfo(fmt.Sprintf("Applied statement '%d' of '%d' of DML migration version '%d'. Updated row count '%d'", i+1, len(statements), nextDmlMigrationVersion, rowCount))
+		rowCounts = append(rowCounts, rowCount)
+	}
+
+	_, err := spannerClient.ReadWriteTransactionWithOptions(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if _, err := txn.BatchUpdateWithOptions(ctx, trackingStatements, queryOptions); err != nil {
 			return err
 		}
-		logInfo(fmt.Sprintf("Inserted version '%d' in DataMigrations table as dirty. Updated row count '%d'", version, rowCount))
-		return nil
-	})
+		return check(ctx, txn, queryOptions, rowCounts)
+	}, transactionOptions)
 	if err != nil {
-		logFatal(fmt.Sprintf("Failed inserting version '%d' in DataMigrations table as dirty: %v", version, err))
+		var failed *assertionError
+		if errors.As(err, &failed) {
+			logFatal(errAssertion, fmt.Sprintf("Failed expectation of DML migrations from version '%d' to version '%d', the statements were applied so %s is left dirty: %v", currentDmlMigrationVersion, nextDmlMigrationVersion, trackingTable("dml"), failed))
+		}
+		logFatal(spannerErrorCategory(err, errDml), fmt.Sprintf("Failed updating %s from version '%d' to version '%d', the statements were applied so it is left dirty: %v", trackingTable("dml"), currentDmlMigrationVersion, nextDmlMigrationVersion, err))
 	}
+	logInfo(fmt.Sprintf("Applied DML migrations from version '%d' to version '%d'. Updated row counts '%d'", currentDmlMigrationVersion, nextDmlMigrationVersion, rowCounts))
+
+	return rowCounts
 }
 
-// SPANNER >--------------------------------------------------
-func newSpannerClient(ctx context.Context, databseConnection string) (*spanner.Client, *database.DatabaseAdminClient) {
-	logDebug(fmt.Sprintf("Initializing spanner data and admin clients"))
+func setDataMigrationsDirty(ctx context.Context, spannerClient *spanner.Client, version int64) {
+	logInfo(fmt.Sprintf("Inserting version '%d' in %s table as dirty", version, dataMigrationsTable))
+
+	_, err := spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		stmt := dialectStatement(fmt.Sprintf("INSERT INTO %s	(Dirty, Version) VALUES (@dirty, @version)", dataMigrationsTable), "dirty", true, "version", version)
+		rowCount, err := txn.Update(ctx, stmt)
+		if err != nil {
+			return err
+		}
+		logInfo(fmt.Sprintf("Inserted version '%d' in %s table as dirty. Updated row count '%d'", version, dataMigrationsTable, rowCount))
+		return nil
+	})
+	if err != nil {
+		logFatal(contentionErrorCategory(err, false, errDml), fmt.Sprintf("Failed inserting version '%d' in %s table as dirty, another run may be applying it: %v", version, dataMigrationsTable, err))
+	}
+}
+
+// CONFIG >--------------------------------------------------
+
+// defaultConfigFile is the config file used when one is not given and it exists in the working directory
+const defaultConfigFile = "migratex.yaml"
+
+// configEnvVarPrefix prefixes the environment variables that override config file settings, e.g. MIGRATEX_TIMEOUT
+const configEnvVarPrefix = "MIGRATEX_"
+
+// configurableFlags can be set on the command line, by a MIGRATEX_* environment variable or by the config file, in
+// that order of precedence. The env_id selects the environment in the config file so cannot itself be set there.
+var configurableFlags = []string{"env_id", "gcp_project_id", "spanner_instance_id", "spanner_database_id", "token_file", "timeout", "log_format", "log_level", "log_env_allowlist", "otel_exporter", "otel_endpoint", "schema_file", "dump_schema", "emulator", "emulator_host", "database_dialect", "stream", "history", "out_of_order"}
+
+// config maps environment IDs to their spanner databases and settings, e.g.
+//
+//	defaults:
+//	  timeout: 30
+//	environments:
+//	  uat:
+//	    gcp_project_id: my-project-uat
+//	    spanner_instance_id: my-instance
+//	    spanner_database_id: my-database
+//	    token_file: tokens.uat.json
+//	groups:
+//	  nonprod: [dev, uat]
+type config struct {
+	Defaults     environmentConfig            `yaml:"defaults"`
+	Environments map[string]environmentConfig `yaml:"environments"`
+	Groups       map[string][]string          `yaml:"groups"`
+
+	// SecretTokens are the tokens whose values are masked in logs, in addition to those secret by name
+	SecretTokens []string `yaml:"secret_tokens"`
+
+	// Streams are independent migration directories applied to the same database, each tracked in its own tables
+	Streams []streamConfig `yaml:"streams"`
+
+	// Policies restrict the environments risky settings are allowed in
+	Policies policiesConfig `yaml:"policies"`
+
+	file string
+}
+
+type environmentConfig struct {
+	GcpProjectId      string `yaml:"gcp_project_id"`
+	SpannerInstanceId string `yaml:"spanner_instance_id"`
+	SpannerDatabaseId string `yaml:"spanner_database_id"`
+	TokenFile         string `yaml:"token_file"`
+	Timeout           int    `yaml:"timeout"`
+	LogFormat         string `yaml:"log_format"`
+	LogLevel          string `yaml:"log_level"`
+	SchemaFile        string `yaml:"schema_file"`
+	DumpSchema        bool   `yaml:"dump_schema"`
+	Emulator          bool   `yaml:"emulator"`
+	EmulatorHost      string `yaml:"emulator_host"`
+	DatabaseDialect   string `yaml:"database_dialect"`
+	History           bool   `yaml:"history"`
+	OutOfOrder        bool   `yaml:"out_of_order"`
+
+	// Databases are the IDs of the spanner databases in the instance migrated by the fleet command
+	Databases []string `yaml:"databases"`
+
+	Hooks hooksConfig `yaml:"hooks"`
+}
+
+// hooksConfig lists the hooks to run at each hook point, where each hook runs a shell command or the DML statements in
+// a SQL file
+type hooksConfig struct {
+	BeforeRun       []hookConfig `yaml:"before_run"`
+	BeforeMigration []hookConfig `yaml:"before_migration"`
+	AfterMigration  []hookConfig `yaml:"after_migration"`
+	AfterRun        []hookConfig `yaml:"after_run"`
+	OnFailure       []hookConfig `yaml:"on_failure"`
+}
+
+type hookConfig struct {
+	Command string `yaml:"command"`
+	Sql     string `yaml:"sql"`
+}
+
+// policiesConfig gives the environment selector of the environments each risky setting is allowed in, where a setting
+// with no policy is allowed in no environment
+type policiesConfig struct {
+	OutOfOrder string `yaml:"out_of_order"`
+}
+
+type streamConfig struct {
+	Name string `yaml:"name"`
+	Dir  string `yaml:"dir"`
+}
+
+// loadConfig loads the config file given by flag or environment variable, or the default config file if it exists,
+// returning nil if there is no config file
+func loadConfig(dir string) *config {
+	f := configFile
+	if f == "" {
+		f = os.Getenv(configEnvVarPrefix + "CONFIG")
+	}
+	if f == "" {
+		f = fmt.Sprintf("%s/%s", dir, defaultConfigFile)
+		if _, err := os.Stat(f); os.IsNotExist(err) {
+			logDebug(fmt.Sprintf("No config file %q", f))
+			return nil
+		}
+	}
+
+	fileBytes, err := ioutil.ReadFile(f)
+	if err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed reading config file %q: %v", f, err))
+	}
+	c := config{file: f}
+	decoder := yaml.NewDecoder(bytes.NewReader(fileBytes))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&c); err != nil && err != io.EOF {
+		logFatal(errConfiguration, fmt.Sprintf("Failed unpacking config file %q into yaml: %v", f, err))
+	}
+	logDebug(fmt.Sprintf("Loaded config file %q with environments %v", f, c.Environments))
+	return &c
+}
+
+// settings returns the flag values of an environment, falling back to the defaults, where relative file paths are
+// relative to the config file
+func (c *config) settings(env string) (map[string]string, error) {
+	e, ok := c.Environments[env]
+	if !ok && len(c.Environments) > 0 {
+		return nil, fmt.Errorf("environment %q is not in config file %q", env, c.file)
+	}
+
+	settings := make(map[string]string)
+	for _, v := range []environmentConfig{c.Defaults, e} {
+		if v.GcpProjectId != "" {
+			settings["gcp_project_id"] = v.GcpProjectId
+		}
+		if v.SpannerInstanceId != "" {
+			settings["spanner_instance_id"] = v.SpannerInstanceId
+		}
+		if v.SpannerDatabaseId != "" {
+			settings["spanner_database_id"] = v.SpannerDatabaseId
+		}
+		if v.TokenFile != "" {
+			tf := v.TokenFile
+			if !filepath.IsAbs(tf) {
+				tf = filepath.Join(filepath.Dir(c.file), tf)
+			}
+			settings["token_file"] = tf
+		}
+		if v.Timeout > 0 {
+			settings["timeout"] = strconv.Itoa(v.Timeout)
+		}
+		if v.LogFormat != "" {
+			settings["log_format"] = v.LogFormat
+		}
+		if v.LogLevel != "" {
+			settings["log_level"] = v.LogLevel
+		}
+		if v.SchemaFile != "" {
+			sf := v.SchemaFile
+			if !filepath.IsAbs(sf) {
+				sf = filepath.Join(filepath.Dir(c.file), sf)
+			}
+			settings["schema_file"] = sf
+		}
+		if v.DumpSchema {
+			settings["dump_schema"] = "true"
+		}
+		if v.Emulator {
+			settings["emulator"] = "true"
+		}
+		if v.EmulatorHost != "" {
+			settings["emulator_host"] = v.EmulatorHost
+		}
+		if v.DatabaseDialect != "" {
+			settings["database_dialect"] = v.DatabaseDialect
+		}
+		if v.History {
+			settings["history"] = "true"
+		}
+		if v.OutOfOrder {
+			settings["out_of_order"] = "true"
+		}
+	}
+	return settings, nil
+}
+
+// resolveSettings sets every configurable flag not given on the command line from its MIGRATEX_* environment variable
+// or, failing that, from the config file
+func resolveSettings(config *config) error {
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+	if setOnCommandLine["env"] {
+		setOnCommandLine["env_id"] = true
+	}
+
+	var settings map[string]string
+	for _, name := range configurableFlags {
+		if setOnCommandLine[name] {
+			continue
+		}
+
+		if v := os.Getenv(configEnvVarPrefix + strings.ToUpper(name)); v != "" {
+			logDebug(fmt.Sprintf("Setting %q from environment variable %s", name, configEnvVarPrefix+strings.ToUpper(name)))
+			if err := flag.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value %q for environment variable %s: %v", v, configEnvVarPrefix+strings.ToUpper(name), err)
+			}
+			continue
+		}
+
+		if config == nil || name == "env_id" {
+			continue
+		}
+		if settings == nil {
+			if envId == "" && verifyAllEnvs {
+				// Each environment is verified by its own migratex process, which resolves its own settings from the
+				// config file
+				continue
+			}
+			if envId == "" {
+				return errors.New("Missing command line argument `env_id`, required to select an environment in the config file")
+			}
+			var err error
+			if settings, err = config.settings(envId); err != nil {
+				return err
+			}
+		}
+		if v, ok := settings[name]; ok {
+			logDebug(fmt.Sprintf("Setting %q from config file %q", name, config.file))
+			if err := flag.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value %q for %q in config file %q: %v", v, name, config.file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// databases returns the IDs of the spanner databases of an environment migrated by the fleet command
+func (c *config) databases(env string) []string {
+	if e, ok := c.Environments[env]; ok && len(e.Databases) > 0 {
+		return e.Databases
+	}
+	return c.Defaults.Databases
+}
+
+// hooks returns the hooks of an environment for each hook point, being the default hooks followed by the hooks of
+// the environment, where relative SQL file paths are relative to the config file
+func (c *config) hooks(env string) map[string][]hookConfig {
+	hooks := make(map[string][]hookConfig)
+	for _, v := range []hooksConfig{c.Defaults.Hooks, c.Environments[env].Hooks} {
+		for point, configs := range map[string][]hookConfig{
+			hookBeforeRun:       v.BeforeRun,
+			hookBeforeMigration: v.BeforeMigration,
+			hookAfterMigration:  v.AfterMigration,
+			hookAfterRun:        v.AfterRun,
+			hookOnFailure:       v.OnFailure,
+		} {
+			for _, h := range configs {
+				if (h.Command == "") == (h.Sql == "") {
+					logFatal(errConfiguration, fmt.Sprintf("Hook %q in config file %q must have exactly one of `command` or `sql`", point, c.file))
+				}
+				if h.Sql != "" && !filepath.IsAbs(h.Sql) {
+					h.Sql = filepath.Join(filepath.Dir(c.file), h.Sql)
+				}
+				hooks[point] = append(hooks[point], h)
+			}
+		}
+	}
+	return hooks
+}
+
+// checkPolicies checks the settings of a run in an environment are allowed by the policies in the config file
+func (c *config) checkPolicies(env string, environments *environments) error {
+	if !outOfOrder {
+		return nil
+	}
+	if c == nil || c.Policies.OutOfOrder == "" {
+		return fmt.Errorf("out of order migrations are not allowed in env %q without an out_of_order policy in the config file selecting the environments they are allowed in", env)
+	}
+	s, err := parseEnvSelector(c.Policies.OutOfOrder, environments)
+	if err != nil {
+		return fmt.Errorf("invalid out_of_order policy %q in config file %q: %v", c.Policies.OutOfOrder, c.file, err)
+	}
+	if !s.matches(env) {
+		return fmt.Errorf("out of order migrations are not allowed in env %q by the out_of_order policy %q in config file %q", env, c.Policies.OutOfOrder, c.file)
+	}
+	return nil
+}
+
+// CONFIG <--------------------------------------------------
+
+// ENVIRONMENTS >--------------------------------------------------
+
+// envSelectorAll selects every environment
+const envSelectorAll = "all"
+
+// environments are the environments and groups of environments declared in the config file
+type environments struct {
+	Environments []string
+	Groups       map[string][]string
+}
+
+// loadEnvironments loads the environments and groups declared in the config file, which are the only declared
+// environments
+func loadEnvironments(config *config) *environments {
+	if config == nil || len(config.Environments) == 0 && len(config.Groups) == 0 {
+		logDebug(fmt.Sprintf("No environments declared in a config file, environment names will not be checked"))
+		return &environments{}
+	}
+
+	e := environments{Groups: config.Groups}
+	for k := range config.Environments {
+		e.Environments = append(e.Environments, k)
+	}
+	sort.Strings(e.Environments)
+	if err := e.check(); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed checking environments in config file %q: %v", config.file, err))
+	}
+	logDebug(fmt.Sprintf("Loaded environments %v and groups %v from %q", e.Environments, e.Groups, config.file))
+	return &e
+}
+
+func (e *environments) declared() bool {
+	return len(e.Environments) > 0
+}
+
+func (e *environments) has(env string) bool {
+	for _, v := range e.Environments {
+		if v == env {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *environments) check() error {
+	if len(e.Groups) > 0 && !e.declared() {
+		return errors.New("groups cannot be declared without environments")
+	}
+	for _, v := range e.Environments {
+		if !isEnvName(v) || v == envSelectorAll {
+			return fmt.Errorf("invalid environment name %q", v)
+		}
+	}
+	for k, v := range e.Groups {
+		if !isEnvName(k) || k == envSelectorAll {
+			return fmt.Errorf("invalid group name %q", k)
+		}
+		if e.has(k) {
+			return fmt.Errorf("group %q has the same name as an environment", k)
+		}
+		for _, env := range v {
+			if !e.has(env) {
+				return fmt.Errorf("group %q contains unknown environment %q", k, env)
+			}
+		}
+	}
+	return nil
+}
+
+// checkEnvironment ensures the environment being migrated is one of the declared environments, if any are declared
+func (e *environments) checkEnvironment(env string) error {
+	if e.declared() && !e.has(env) {
+		return fmt.Errorf("unknown environment %q, expected one of %v", env, e.Environments)
+	}
+	return nil
+}
+
+// envSelector selects the environments a migration applies to. Selectors are a sequence of terms where `+name`
+// includes an environment, `!name` excludes one and a `@` before the name refers to a group instead, e.g. `+dev+uat`,
+// `!prod` or `@nonprod!qa`. The leading `+` of the first term may be omitted and `all` includes every environment.
+// A selector with only exclusions includes every environment that is not excluded, so excluding an environment
+// requires the environments to be declared.
+type envSelector struct {
+	all     bool
+	include map[string]bool
+	exclude map[string]bool
+}
+
+func parseEnvSelector(selector string, environments *environments) (*envSelector, error) {
+	s := &envSelector{include: make(map[string]bool), exclude: make(map[string]bool)}
+
+	if selector == "" {
+		return nil, errors.New("empty selector")
+	}
+
+	for i := 0; i < len(selector); {
+		exclude := false
+		switch selector[i] {
+		case '+':
+			i++
+		case '!':
+			exclude = true
+			i++
+		default:
+			if i > 0 {
+				return nil, fmt.Errorf("unexpected %q at position %d", selector[i], i)
+			}
+		}
+
+		group := false
+		if i < len(selector) && selector[i] == '@' {
+			group = true
+			i++
+		}
+
+		j := i
+		for j < len(selector) && isEnvNameChar(rune(selector[j])) {
+			j++
+		}
+		name := selector[i:j]
+		if name == "" {
+			return nil, fmt.Errorf("missing environment or group name at position %d", i)
+		}
+		i = j
+
+		var envs []string
+		switch {
+		case group:
+			members, ok := environments.Groups[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown group %q", name)
+			}
+			envs = members
+		case name == envSelectorAll:
+			if exclude {
+				return nil, fmt.Errorf("%q cannot be excluded", envSelectorAll)
+			}
+			s.all = true
+			continue
+		default:
+			if err := environments.checkEnvironment(name); err != nil {
+				return nil, err
+			}
+			if exclude && !environments.declared() {
+				// A misspelt environment would otherwise go unnoticed and select every environment
+				return nil, fmt.Errorf("environment %q cannot be excluded without declared environments", name)
+			}
+			envs = []string{name}
+		}
+
+		for _, v := range envs {
+			if exclude {
+				s.exclude[v] = true
+			} else {
+				s.include[v] = true
+			}
+		}
+	}
+
+	if !s.all && len(s.include) == 0 {
+		s.all = true
+	}
+
+	return s, nil
+}
+
+func (s *envSelector) matches(env string) bool {
+	return (s.all || s.include[env]) && !s.exclude[env]
+}
+
+func isEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !isEnvNameChar(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEnvNameChar(r rune) bool {
+	return r == '_' || r == '-' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+// ENVIRONMENTS <--------------------------------------------------
+
+// STREAMS >--------------------------------------------------
+
+const (
+	defaultSchemaMigrationsTable = "SchemaMigrations"
+	defaultDataMigrationsTable   = "DataMigrations"
+)
+
+// The stream being migrated, empty for the unnamed stream, and the tables tracking its DDL and DML migrations
+var (
+	migrationStream       string
+	schemaMigrationsTable = defaultSchemaMigrationsTable
+	dataMigrationsTable   = defaultDataMigrationsTable
+)
+
+var streamNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// migrationStreams returns the streams to migrate, those in the config file, or only the one given by the `stream`
+// command line argument, otherwise the stream given by the `stream` command line argument, if any, in the working
+// directory
+func migrationStreams(workingDir string, config *config) []streamConfig {
+	var streams []streamConfig
+	for _, v := range configuredStreams(workingDir, config) {
+		if stream == "" || stream == v.Name {
+			streams = append(streams, v)
+		}
+	}
+	if len(streams) == 0 {
+		logFatal(errConfiguration, fmt.Sprintf("Stream %q is not in config file %q", stream, config.file))
+	}
+	return streams
+}
+
+// configuredStreams returns every stream in the config file, with dirs relative to the config file, otherwise the
+// stream given by the `stream` command line argument, if any, in the working directory
+func configuredStreams(workingDir string, config *config) []streamConfig {
+	if config == nil || len(config.Streams) == 0 {
+		if stream != "" && !streamNamePattern.MatchString(stream) {
+			logFatal(errConfiguration, fmt.Sprintf("Invalid command line argument `stream` %q, must start with a letter followed by letters, digits or underscores", stream))
+		}
+		return []streamConfig{{Name: stream, Dir: workingDir}}
+	}
+
+	var streams []streamConfig
+	names := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, v := range config.Streams {
+		if !streamNamePattern.MatchString(v.Name) {
+			logFatal(errConfiguration, fmt.Sprintf("Invalid stream name %q in config file %q, must start with a letter followed by letters, digits or underscores", v.Name, config.file))
+		}
+		if v.Dir == "" {
+			logFatal(errConfiguration, fmt.Sprintf("Stream %q in config file %q has no dir", v.Name, config.file))
+		}
+		if !filepath.IsAbs(v.Dir) {
+			v.Dir = filepath.Join(filepath.Dir(config.file), v.Dir)
+		}
+		if names[v.Name] || dirs[v.Dir] {
+			logFatal(errConfiguration, fmt.Sprintf("Stream %q in config file %q has the same name or dir as another stream", v.Name, config.file))
+		}
+		names[v.Name], dirs[v.Dir] = true, true
+		streams = append(streams, v)
+	}
+	return streams
+}
+
+// singleStream returns the one stream a command acting on a single stream migrates, setting its tracking tables
+func singleStream(workingDir string, config *config) streamConfig {
+	streams := migrationStreams(workingDir, config)
+	if len(streams) > 1 {
+		logFatal(errConfiguration, fmt.Sprintf("Missing command line argument `stream`, config file %q has '%d' streams", config.file, len(streams)))
+	}
+	setStream(streams[0].Name)
+	return streams[0]
+}
+
+// setStream sets the tables tracking migrations to those of a stream, or the default tables for the unnamed stream
+func setStream(name string) {
+	migrationStream = name
+	schemaMigrationsTable, dataMigrationsTable = defaultSchemaMigrationsTable, defaultDataMigrationsTable
+	migrationHistoryTable = defaultMigrationHistoryTable
+	repeatableMigrationsTable = defaultRepeatableMigrationsTable
+	if name != "" {
+		schemaMigrationsTable = fmt.Sprintf("%s_%s", defaultSchemaMigrationsTable, name)
+		dataMigrationsTable = fmt.Sprintf("%s_%s", defaultDataMigrationsTable, name)
+		migrationHistoryTable = fmt.Sprintf("%s_%s", defaultMigrationHistoryTable, name)
+		repeatableMigrationsTable = fmt.Sprintf("%s_%s", defaultRepeatableMigrationsTable, name)
+	}
+}
+
+// STREAMS <--------------------------------------------------
+
+// HISTORY >--------------------------------------------------
+
+const defaultMigrationHistoryTable = "MigrationHistory"
+
+// migrationHistoryTable tracks every applied DDL and DML migration of the stream being migrated in its own row, keyed
+// by revision and kind, when the `history` command line argument is set
+var migrationHistoryTable = defaultMigrationHistoryTable
+
+// appliedMigration is a row of the migration history
+type appliedMigration struct {
+	revision int64
+	kind     string
+	name     string
+	dirty    bool
+}
+
+func (m appliedMigration) key() string {
+	return fmt.Sprintf("%d/%s", m.revision, m.kind)
+}
+
+func migrationHistoryTableDdl() string {
+	if isPostgresql() {
+		return fmt.Sprintf("CREATE TABLE %s (Revision BIGINT NOT NULL, Kind VARCHAR(8) NOT NULL, Name VARCHAR NOT NULL, Dirty BOOLEAN NOT NULL, AppliedAt SPANNER.COMMIT_TIMESTAMP NOT NULL, PRIMARY KEY (Revision, Kind))", migrationHistoryTable)
+	}
+	return fmt.Sprintf("CREATE TABLE %s (Revision INT64 NOT NULL, Kind STRING(8) NOT NULL, Name STRING(MAX) NOT NULL, Dirty BOOL NOT NULL, AppliedAt TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true)) PRIMARY KEY (Revision, Kind)", migrationHistoryTable)
+}
+
+func pendingCommitTimestamp() string {
+	if isPostgresql() {
+		return "SPANNER.PENDING_COMMIT_TIMESTAMP()"
+	}
+	return "PENDING_COMMIT_TIMESTAMP()"
+}
+
+// trackingTable returns the table tracking migrations of a kind, for messages
+func trackingTable(kind string) string {
+	if useHistory {
+		return migrationHistoryTable
+	}
+	if kind == "ddl" {
+		return schemaMigrationsTable
+	}
+	return dataMigrationsTable
+}
+
+// readMigrationHistory returns the applied migrations in the order they are applied in, see sortMigrations
+func readMigrationHistory(ctx context.Context, spannerClient *spanner.Client) []appliedMigration {
+	ctx, span := startSpan(ctx, "readMigrationHistory", attribute.String("migratex.table", migrationHistoryTable))
+	defer endSpan(span)
+
+	var history []appliedMigration
+	stmt := dialectStatement(fmt.Sprintf("SELECT Revision, Kind, Name, Dirty FROM %s ORDER BY Revision, Kind", migrationHistoryTable))
+	err := spannerClient.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var m appliedMigration
+		if err := row.Columns(&m.revision, &m.kind, &m.name, &m.dirty); err != nil {
+			return err
+		}
+		history = append(history, m)
+		return nil
+	})
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errUnexpected), fmt.Sprintf("Failed reading applied migrations in table %q: %v", migrationHistoryTable, err))
+	}
+	logInfo(fmt.Sprintf("Found '%d' applied migrations in table %q", len(history), migrationHistoryTable))
+	return history
+}
+
+// lastAppliedMigration returns whether the migrations of a kind are dirty and the last applied version, from the
+// migration history or from SchemaMigrations or DataMigrations
+func lastAppliedMigration(ctx context.Context, spannerClient *spanner.Client, kind string) (bool, int64) {
+	if !useHistory {
+		return determineLastMigration(ctx, spannerClient, trackingTable(kind))
+	}
+	var dirty bool
+	var version int64
+	for _, v := range readMigrationHistory(ctx, spannerClient) {
+		if v.kind == kind {
+			dirty = dirty || v.dirty
+			version = v.revision
+		}
+	}
+	return dirty, version
+}
+
+// appliedRevisions returns the revisions of the applied migrations of a kind in the migration history
+func appliedRevisions(ctx context.Context, spannerClient *spanner.Client, kind string) map[int64]bool {
+	revisions := make(map[int64]bool)
+	for _, v := range readMigrationHistory(ctx, spannerClient) {
+		if v.kind == kind && !v.dirty {
+			revisions[v.revision] = true
+		}
+	}
+	return revisions
+}
+
+// outstandingHistoryMigrations returns the available migrations, in order, with no row in the migration history, along
+// with those that come before the last applied migration. Since migrations are applied in order such a migration is
+// inconsistent unless the `out_of_order` command line argument is set, as is a dirty migration.
+func outstandingHistoryMigrations(availableMigrations []string, history []appliedMigration) (outstanding []string, outOfOrderMigrations []string) {
+	logInfo(fmt.Sprintf("Determining outstanding migrations..."))
+
+	applied := make(map[string]bool)
+	for _, v := range history {
+		if v.dirty {
+			logFatal(errDirtyState, fmt.Sprintf("Migration %q is dirty in table %q, this must be manually fixed before more migrations can be applied", v.name, migrationHistoryTable))
+		}
+		applied[v.key()] = true
+	}
+
+	migrations := append([]string(nil), availableMigrations...)
+	sortMigrations(migrations)
+
+	found := 0
+	for _, v := range migrations {
+		revision, err := migrationVersion(v)
+		if err != nil {
+			logFatal(errDiscovery, fmt.Sprintf("Failed determining migration version from file name %q: %v", v, err))
+		}
+		m := appliedMigration{revision: revision, kind: migrationKind(v), name: v}
+		if applied[m.key()] {
+			found++
+			continue
+		}
+		if len(history) > 0 {
+			last := history[len(history)-1]
+			if revision < last.revision || revision == last.revision && m.kind < last.kind {
+				if !outOfOrder {
+					logFatal(errInconsistentState, fmt.Sprintf("Found inconsistent migration state. Outstanding migration %q should have already been applied since it comes before the last applied migration %q, use `-out_of_order` to apply it anyway", v, last.name))
+				}
+				outOfOrderMigrations = append(outOfOrderMigrations, v)
+			}
+		}
+		outstanding = append(outstanding, v)
+	}
+	if found < len(history) {
+		logInfo(fmt.Sprintf("Found '%d' applied migrations in table %q that are no longer available, such as squashed migrations", len(history)-found, migrationHistoryTable))
+	}
+
+	logInfo(fmt.Sprintf("Found '%d' outstanding migrations: %v", len(outstanding), outstanding))
+	if len(outOfOrderMigrations) > 0 {
+		logNotice(fmt.Sprintf("Found '%d' outstanding migrations that come before the last applied migration %q, they will be applied out of order: %v", len(outOfOrderMigrations), history[len(history)-1].name, outOfOrderMigrations))
+	}
+	return
+}
+
+// convertLegacyMigrations records the migrations SchemaMigrations and DataMigrations imply were applied, every
+// available DDL and DML migration up to their versions, in the empty migration history, leaving both tables as they are
+func convertLegacyMigrations(ctx context.Context, spannerClient *spanner.Client, availableDdlMigrations, availableDmlMigrations []string) []appliedMigration {
+	var lastMigrations [2]int64
+	for i, table := range []string{schemaMigrationsTable, dataMigrationsTable} {
+		if !tableExists(ctx, spannerClient, table) {
+			logDebug(fmt.Sprintf("No %q table to convert", table))
+			continue
+		}
+		dirty, lastMigration := determineLastMigration(ctx, spannerClient, table)
+		if dirty {
+			logFatal(errDirtyState, fmt.Sprintf("%s table is dirty, this must be manually fixed before it can be converted into the %s table", table, migrationHistoryTable))
+		}
+		lastMigrations[i] = lastMigration
+	}
+	history := legacyAppliedMigrations(availableDdlMigrations, availableDmlMigrations, lastMigrations[0], lastMigrations[1])
+	if len(history) == 0 {
+		return nil
+	}
+
+	logInfo(fmt.Sprintf("Converting %s and %s into table %q with '%d' applied migrations...", schemaMigrationsTable, dataMigrationsTable, migrationHistoryTable, len(history)))
+	if _, err := spannerClient.Apply(ctx, appliedMigrationMutations(history)); err != nil {
+		logFatal(spannerErrorCategory(err, errDml), fmt.Sprintf("Failed converting %s and %s into table %q: %v", schemaMigrationsTable, dataMigrationsTable, migrationHistoryTable, err))
+	}
+	logInfo(fmt.Sprintf("Converted %s and %s into table %q with '%d' applied migrations", schemaMigrationsTable, dataMigrationsTable, migrationHistoryTable, len(history)))
+	return history
+}
+
+// legacyAppliedMigrations returns the migrations implied to be applied by the last DDL and DML migration versions, every
+// available migration of each kind up to its version, in the order they are applied in
+func legacyAppliedMigrations(availableDdlMigrations, availableDmlMigrations []string, lastDdlMigration, lastDmlMigration int64) []appliedMigration {
+	var history []appliedMigration
+	for _, v := range append(append([]string(nil), availableDdlMigrations...), availableDmlMigrations...) {
+		lastMigration := lastDmlMigration
+		if migrationKind(v) == "ddl" {
+			lastMigration = lastDdlMigration
+		}
+		if revision, err := migrationVersion(v); err == nil && revision <= lastMigration {
+			history = append(history, appliedMigration{revision: revision, kind: migrationKind(v), name: v})
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		if history[i].revision != history[j].revision {
+			return history[i].revision < history[j].revision
+		}
+		return history[i].kind < history[j].kind
+	})
+	return history
+}
+
+// appliedMigrationMutations inserts applied migrations into the migration history
+func appliedMigrationMutations(history []appliedMigration) []*spanner.Mutation {
+	columns := []string{dialectIdentifier("Revision"), dialectIdentifier("Kind"), dialectIdentifier("Name"), dialectIdentifier("Dirty"), dialectIdentifier("AppliedAt")}
+	var mutations []*spanner.Mutation
+	for _, v := range history {
+		mutations = append(mutations, spanner.Insert(dialectIdentifier(migrationHistoryTable), columns, []interface{}{v.revision, v.kind, v.name, v.dirty, spanner.CommitTimestamp}))
+	}
+	return mutations
+}
+
+func tableExists(ctx context.Context, spannerClient *spanner.Client, table string) bool {
+	stmt := dialectStatement("SELECT COUNT(*) FROM information_schema.tables WHERE table_name = @name", "name", dialectIdentifier(table))
+	var count int64
+	if err := spannerClient.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		return row.Columns(&count)
+	}); err != nil {
+		logFatal(spannerErrorCategory(err, errUnexpected), fmt.Sprintf("Failed determining if table %q exists: %v", table, err))
+	}
+	return count > 0
+}
+
+// insertDirtyMigration records a migration in the migration history as dirty before it is applied
+func insertDirtyMigration(ctx context.Context, spannerClient *spanner.Client, migration string) {
+	revision, err := migrationVersion(migration)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed determining migration version from file name %q: %v", migration, err))
+	}
+	logInfo(fmt.Sprintf("Inserting migration %q in %s table as dirty", migration, migrationHistoryTable))
+
+	_, err = spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		stmt := dialectStatement(fmt.Sprintf("INSERT INTO %s (Revision, Kind, Name, Dirty, AppliedAt) VALUES (@revision, @kind, @name, @dirty, %s)", migrationHistoryTable, pendingCommitTimestamp()), "revision", revision, "kind", migrationKind(migration), "name", migration, "dirty", true)
+		_, err := txn.Update(ctx, stmt)
+		return err
+	})
+	if err != nil {
+		logFatal(contentionErrorCategory(err, false, errDml), fmt.Sprintf("Failed inserting migration %q in %s table as dirty, another run may be applying it: %v", migration, migrationHistoryTable, err))
+	}
+}
+
+// markMigrationApplied marks a DDL migration inserted as dirty by insertDirtyMigration as applied once it has been
+func markMigrationApplied(ctx context.Context, spannerClient *spanner.Client, migration string) {
+	_, err := spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		_, err := txn.Update(ctx, appliedMigrationStatement(migration))
+		return err
+	})
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errDdl), fmt.Sprintf("Failed marking migration %q as applied in %s table, it is left dirty: %v", migration, migrationHistoryTable, err))
+	}
+}
+
+// appliedMigrationStatement marks a migration inserted as dirty by insertDirtyMigration as applied
+func appliedMigrationStatement(migration string) spanner.Statement {
+	revision, _ := migrationVersion(migration)
+	return dialectStatement(fmt.Sprintf("UPDATE %s SET Dirty=@dirty, AppliedAt=%s WHERE Revision=@revision AND Kind=@kind", migrationHistoryTable, pendingCommitTimestamp()), "dirty", false, "revision", revision, "kind", migrationKind(migration))
+}
+
+// HISTORY <--------------------------------------------------
+
+// REPEATABLE >--------------------------------------------------
+
+const (
+	// repeatableMigrationPrefix and repeatableMigrationSuffix mark a repeatable DDL migration, e.g.
+	// 'R_view_active_users.ddl.sql', which has no revision and is applied again whenever it changes
+	repeatableMigrationPrefix = "R_"
+	repeatableMigrationSuffix = ".ddl.sql"
+
+	defaultRepeatableMigrationsTable = "RepeatableMigrations"
+)
+
+// repeatableMigrationsTable tracks the checksum each repeatable migration of the stream being migrated was last applied
+// with
+var repeatableMigrationsTable = defaultRepeatableMigrationsTable
+
+type repeatableMigration struct {
+	name     string
+	content  string
+	checksum string
+}
+
+func isRepeatableMigration(migration string) bool {
+	return strings.HasPrefix(migration, repeatableMigrationPrefix) && strings.HasSuffix(migration, repeatableMigrationSuffix)
+}
+
+func repeatableMigrationsTableDdl() string {
+	if isPostgresql() {
+		return fmt.Sprintf("CREATE TABLE %s (Name VARCHAR NOT NULL, Checksum VARCHAR(64) NOT NULL, AppliedAt SPANNER.COMMIT_TIMESTAMP NOT NULL, PRIMARY KEY (Name))", repeatableMigrationsTable)
+	}
+	return fmt.Sprintf("CREATE TABLE %s (Name STRING(MAX) NOT NULL, Checksum STRING(64) NOT NULL, AppliedAt TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp=true)) PRIMARY KEY (Name)", repeatableMigrationsTable)
+}
+
+// determineRepeatableMigrations reads the repeatable migrations in a directory, in file name order
+func determineRepeatableMigrations(dir string) []repeatableMigration {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed reading files in directory %q: %v", dir, err))
+	}
+
+	var repeatable []repeatableMigration
+	for _, v := range files {
+		if v.IsDir() || !isRepeatableMigration(v.Name()) {
+			continue
+		}
+		f := filepath.Join(dir, v.Name())
+		fileBytes, err := ioutil.ReadFile(f)
+		if err != nil {
+			logFatal(errDiscovery, fmt.Sprintf("Failed reading repeatable migration file %q: %v", f, err))
+		}
+		sum := sha256.Sum256(fileBytes)
+		repeatable = append(repeatable, repeatableMigration{name: v.Name(), content: string(fileBytes), checksum: hex.EncodeToString(sum[:])})
+	}
+
+	logInfo(fmt.Sprintf("Found '%d' repeatable migrations", len(repeatable)))
+	return repeatable
+}
+
+// readRepeatableChecksums returns the checksum each repeatable migration was last applied with
+func readRepeatableChecksums(ctx context.Context, spannerClient *spanner.Client) map[string]string {
+	checksums := make(map[string]string)
+	stmt := dialectStatement(fmt.Sprintf("SELECT Name, Checksum FROM %s", repeatableMigrationsTable))
+	err := spannerClient.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var name, checksum string
+		if err := row.Columns(&name, &checksum); err != nil {
+			return err
+		}
+		checksums[name] = checksum
+		return nil
+	})
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errUnexpected), fmt.Sprintf("Failed reading checksums of repeatable migrations in table %q: %v", repeatableMigrationsTable, err))
+	}
+	return checksums
+}
+
+// applyRepeatableMigrations applies the repeatable migrations of a stream that are new or have changed since they were
+// last applied, after its versioned migrations
+func applyRepeatableMigrations(ctx context.Context, spannerClient *spanner.Client, spannerAdminClient *database.DatabaseAdminClient, dir string) {
+	repeatable := determineRepeatableMigrations(dir)
+	if len(repeatable) == 0 {
+		return
+	}
+
+	databseConnection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
+	createMigrationTableIfNecessary(ctx, spannerAdminClient, databseConnection, repeatableMigrationsTable)
+	checksums := readRepeatableChecksums(ctx, spannerClient)
+
+	_, changed := pendingRepeatableMigrations(repeatable, checksums)
+	var names []string
+	for _, v := range changed {
+		names = append(names, v.name)
+	}
+	logInfo(fmt.Sprintf("Found '%d' new or changed repeatable migrations: %v", len(changed), names))
+	if len(changed) == 0 {
+		return
+	}
+
+	report.pending(names)
+
+	for _, v := range changed {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			logFatal(errInterrupted, fmt.Sprintf("Interrupted before applying repeatable migration %q", v.name))
+		}
+
+		migrationHookEnv := hookEnv{migration: v.name}
+		runHooks.run(ctx, hookBeforeMigration, migrationHookEnv)
+
+		report.started(v.name)
+		func() {
+			ctx, span := startMigrationSpan(ctx, v.name)
+			defer endMigrationSpan(span, v.name, time.Now())
+
+			applyRepeatableMigration(ctx, spannerClient, spannerAdminClient, v)
+		}()
+		report.succeeded()
+
+		runHooks.run(ctx, hookAfterMigration, migrationHookEnv)
+	}
+}
+
+// applyRepeatableMigration applies the DDL statements of a repeatable migration and then records its checksum. A
+// repeatable migration redefines its objects in place, so if the checksum is not recorded it is simply applied again.
+func applyRepeatableMigration(ctx context.Context, spannerClient *spanner.Client, spannerAdminClient *database.DatabaseAdminClient, migration repeatableMigration) {
+	logInfo(fmt.Sprintf("Applying repeatable migration %q with checksum %q", migration.name, migration.checksum))
+
+	split, err := splitStatements(migration.content)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed splitting repeatable migration file %q into statements: %v", migration.name, err))
+	}
+	var statements []string
+	for _, v := range split {
+		statements = append(statements, v.sql)
+	}
+
+	ddlCtx, cancel := ddlContext(ctx)
+	defer cancel()
+
+	if len(statements) > 0 {
+		databseConnection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
+		op, err := spannerAdminClient.UpdateDatabaseDdl(ddlCtx, &adminpb.UpdateDatabaseDdlRequest{Database: databseConnection, Statements: statements})
+		if err == nil {
+			err = op.Wait(ddlCtx)
+		}
+		if err != nil {
+			logFatal(spannerErrorCategory(err, errDdl), fmt.Sprintf("Failed applying repeatable migration %q: %v", migration.name, err))
+		}
+	}
+
+	columns := []string{dialectIdentifier("Name"), dialectIdentifier("Checksum"), dialectIdentifier("AppliedAt")}
+	mutation := spanner.InsertOrUpdate(dialectIdentifier(repeatableMigrationsTable), columns, []interface{}{migration.name, migration.checksum, spanner.CommitTimestamp})
+	if _, err := spannerClient.Apply(ddlCtx, []*spanner.Mutation{mutation}); err != nil {
+		logFatal(spannerErrorCategory(err, errDdl), fmt.Sprintf("Failed recording checksum of repeatable migration %q in %s table, it will be applied again: %v", migration.name, repeatableMigrationsTable, err))
+	}
+	logInfo(fmt.Sprintf("Applied repeatable migration %q", migration.name))
+}
+
+// pendingRepeatableMigrations splits repeatable migrations into those applied with their current checksum and those
+// that are new or have changed since they were last applied
+func pendingRepeatableMigrations(repeatable []repeatableMigration, checksums map[string]string) (unchanged []repeatableMigration, pending []repeatableMigration) {
+	for _, v := range repeatable {
+		if checksums[v.name] == v.checksum {
+			logDebug(fmt.Sprintf("Repeatable migration %q is unchanged since it was last applied", v.name))
+			unchanged = append(unchanged, v)
+		} else {
+			pending = append(pending, v)
+		}
+	}
+	return
+}
+
+// appliedRepeatableMigrations returns the paths of the repeatable migrations in a directory that have been applied in
+// their current version. Those that are new or have changed are pending, since the version applied is not known.
+func appliedRepeatableMigrations(ctx context.Context, spannerClient *spanner.Client, dir string) []string {
+	if !tableExists(ctx, spannerClient, repeatableMigrationsTable) {
+		return nil
+	}
+	unchanged, pending := pendingRepeatableMigrations(determineRepeatableMigrations(dir), readRepeatableChecksums(ctx, spannerClient))
+	if len(pending) > 0 {
+		var names []string
+		for _, v := range pending {
+			names = append(names, v.name)
+		}
+		logNotice(fmt.Sprintf("Found '%d' new or changed repeatable migrations pending in directory %q, which are not replayed: %v", len(pending), dir, names))
+	}
+
+	var paths []string
+	for _, v := range unchanged {
+		paths = append(paths, filepath.Join(dir, v.name))
+	}
+	return paths
+}
+
+// REPEATABLE <--------------------------------------------------
+
+// DIALECT >--------------------------------------------------
+
+const (
+	dialectGoogleSql  = "googlesql"
+	dialectPostgresql = "postgresql"
+)
+
+// dialect is the SQL dialect of the database being migrated, detected from its metadata, which before detection is the
+// dialect of databases created in the emulator
+var dialect = adminpb.DatabaseDialect_GOOGLE_STANDARD_SQL
+
+var dialectParamPattern = regexp.MustCompile(`@([A-Za-z_][A-Za-z0-9_]*)`)
+
+func resolveDialect() error {
+	switch databaseDialect {
+	case dialectGoogleSql:
+		dialect = adminpb.DatabaseDialect_GOOGLE_STANDARD_SQL
+	case dialectPostgresql:
+		dialect = adminpb.DatabaseDialect_POSTGRESQL
+	default:
+		return fmt.Errorf("invalid database dialect %q, expected %q or %q", databaseDialect, dialectGoogleSql, dialectPostgresql)
+	}
+	return nil
+}
+
+// detectDialect determines the dialect of the database from its metadata
+func detectDialect(ctx context.Context, spannerAdminClient *database.DatabaseAdminClient, databseConnection string) {
+	db, err := spannerAdminClient.GetDatabase(ctx, &adminpb.GetDatabaseRequest{Name: databseConnection})
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errConfiguration), fmt.Sprintf("Failed getting database %q to determine its dialect: %v", databseConnection, err))
+	}
+	dialect = db.DatabaseDialect
+	if dialect == adminpb.DatabaseDialect_DATABASE_DIALECT_UNSPECIFIED {
+		dialect = adminpb.DatabaseDialect_GOOGLE_STANDARD_SQL
+	}
+	logInfo(fmt.Sprintf("Database %q has dialect %s", databseConnection, dialect))
+}
+
+func isPostgresql() bool {
+	return dialect == adminpb.DatabaseDialect_POSTGRESQL
+}
+
+// dialectStatement creates a statement from GoogleSQL with `@name` parameters and their name and value pairs, which
+// for PostgreSQL-dialect databases become positional `$1` parameters, e.g.
+// dialectStatement("DELETE FROM DataMigrations WHERE Version=@version", "version", 3)
+func dialectStatement(sql string, params ...interface{}) spanner.Statement {
+	stmt := spanner.Statement{SQL: sql, Params: make(map[string]interface{})}
+	positions := make(map[string]int)
+	for i := 0; i+1 < len(params); i += 2 {
+		name := params[i].(string)
+		positions[name] = i/2 + 1
+		if isPostgresql() {
+			stmt.Params[fmt.Sprintf("p%d", i/2+1)] = params[i+1]
+		} else {
+			stmt.Params[name] = params[i+1]
+		}
+	}
+	if isPostgresql() {
+		stmt.SQL = dialectParamPattern.ReplaceAllStringFunc(sql, func(param string) string {
+			if position, ok := positions[param[1:]]; ok {
+				return fmt.Sprintf("$%d", position)
+			}
+			return param
+		})
+	}
+	return stmt
+}
+
+// dialectIdentifier returns the name of a table or column created unquoted, which PostgreSQL-dialect databases fold to
+// lower case, as used by mutations
+func dialectIdentifier(name string) string {
+	if isPostgresql() {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+func migrationTableDdl(migrationTableName string) string {
+	if migrationTableName == migrationHistoryTable {
+		return migrationHistoryTableDdl()
+	}
+	if migrationTableName == repeatableMigrationsTable {
+		return repeatableMigrationsTableDdl()
+	}
+	if isPostgresql() {
+		return fmt.Sprintf("CREATE TABLE %s (Version BIGINT NOT NULL, Dirty BOOLEAN NOT NULL, PRIMARY KEY (Version))", migrationTableName)
+	}
+	return fmt.Sprintf("CREATE TABLE %s (Version INT64 NOT NULL, Dirty BOOL NOT NULL) PRIMARY KEY (Version)", migrationTableName)
+}
+
+func createDatabaseStatement(databaseId string) string {
+	if isPostgresql() {
+		return fmt.Sprintf("CREATE DATABASE \"%s\"", databaseId)
+	}
+	return fmt.Sprintf("CREATE DATABASE `%s`", databaseId)
+}
+
+// applyDdlMigrationDirectly applies a DDL migration with the database admin API rather than 'migrate', which only
+// supports GoogleSQL and SchemaMigrations, tracking it in SchemaMigrations the same way 'migrate' does: a single row
+// holding the version, dirty while the migration is applied, or in its own row of the migration history
+func applyDdlMigrationDirectly(ctx context.Context, spannerClient *spanner.Client, spannerAdminClient *database.DatabaseAdminClient, dir, migration string) {
+	logInfo(fmt.Sprintf("Applying next DDL migration %q from directory %q", migration, dir))
+
+	version, err := migrationVersion(migration)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed determining DDL migration version from file name %q: %v", migration, err))
+	}
+	f := fmt.Sprintf("%s/%s", dir, migration)
+	fileBytes, err := ioutil.ReadFile(f)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed reading DDL migration file %q: %v", f, err))
+	}
+	split, err := splitStatements(string(fileBytes))
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed splitting DDL migration file %q into statements: %v", f, err))
+	}
+	var statements []string
+	for _, v := range split {
+		statements = append(statements, v.sql)
+	}
+
+	if useHistory {
+		insertDirtyMigration(ctx, spannerClient, migration)
+	} else {
+		setSchemaMigrationsVersion(ctx, spannerClient, version, true)
+	}
+
+	databseConnection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
+	ddlCtx, cancel := ddlContext(ctx)
+	defer cancel()
+	op, err := spannerAdminClient.UpdateDatabaseDdl(ddlCtx, &adminpb.UpdateDatabaseDdlRequest{Database: databseConnection, Statements: statements})
+	if err == nil {
+		err = op.Wait(ddlCtx)
+	}
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errDdl), fmt.Sprintf("Failed applying DDL migration %q, %s is left dirty: %v", migration, trackingTable("ddl"), err))
+	}
+
+	if useHistory {
+		markMigrationApplied(ddlCtx, spannerClient, migration)
+	} else {
+		setSchemaMigrationsVersion(ddlCtx, spannerClient, version, false)
+	}
+	logInfo(fmt.Sprintf("Applied DDL migration %q", migration))
+}
+
+func setSchemaMigrationsVersion(ctx context.Context, spannerClient *spanner.Client, version int64, dirty bool) {
+	_, err := spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		_, err := txn.BatchUpdate(ctx, []spanner.Statement{
+			dialectStatement(fmt.Sprintf("DELETE FROM %s WHERE Version IS NOT NULL", schemaMigrationsTable)),
+			dialectStatement(fmt.Sprintf("INSERT INTO %s (Version, Dirty) VALUES (@version, @dirty)", schemaMigrationsTable), "version", version, "dirty", dirty),
+		})
+		return err
+	})
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errDdl), fmt.Sprintf("Failed setting %s to version '%d' with dirty '%t': %v", schemaMigrationsTable, version, dirty, err))
+	}
+}
+
+// DIALECT <--------------------------------------------------
+
+// DIRECTIVES >--------------------------------------------------
+
+// migrationDirectivePrefix marks a header comment holding directives for a migration, e.g. `-- migratex: env=!prod`
+const migrationDirectivePrefix = "-- migratex:"
+
+var knownMigrationDirectives = map[string]bool{
+	"env":               true,
+	"transaction":       true,
+	"priority":          true,
+	"timeout":           true,
+	"allow_destructive": true,
+}
+
+const (
+	transactionSingle      = "single"
+	transactionNone        = "none"
+	transactionPartitioned = "partitioned"
+)
+
+var migrationPriorities = map[string]sppb.RequestOptions_Priority{
+	"low":    sppb.RequestOptions_PRIORITY_LOW,
+	"medium": sppb.RequestOptions_PRIORITY_MEDIUM,
+	"high":   sppb.RequestOptions_PRIORITY_HIGH,
+}
+
+// migrationOptions control how the statements of a DML migration are applied, as given by its directives, e.g.
+// `-- migratex: transaction=none, priority=low, timeout=10m`. By default they are applied in a single transaction at
+// high priority, within the timeout of the run, and statements changing every row of a table are rejected.
+type migrationOptions struct {
+	transaction      string
+	priority         sppb.RequestOptions_Priority
+	timeout          time.Duration
+	allowDestructive bool
+}
+
+func parseMigrationOptions(directives map[string]string) (migrationOptions, error) {
+	options := migrationOptions{transaction: transactionSingle}
+
+	if v, ok := directives["transaction"]; ok {
+		if v != transactionSingle && v != transactionNone && v != transactionPartitioned {
+			return options, fmt.Errorf("invalid transaction %q, expected %q, %q or %q", v, transactionSingle, transactionNone, transactionPartitioned)
+		}
+		options.transaction = v
+	}
+	if v, ok := directives["priority"]; ok {
+		priority, ok := migrationPriorities[v]
+		if !ok {
+			return options, fmt.Errorf("invalid priority %q, expected low, medium or high", v)
+		}
+		options.priority = priority
+	}
+	if v, ok := directives["timeout"]; ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return options, fmt.Errorf("invalid timeout %q, expected a positive duration such as 10m", v)
+		}
+		options.timeout = timeout
+	}
+	if v, ok := directives["allow_destructive"]; ok {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return options, fmt.Errorf("invalid allow_destructive %q, expected true or false", v)
+		}
+		options.allowDestructive = allow
+	}
+	return options, nil
+}
+
+var (
+	destructiveStatementPattern = regexp.MustCompile(`(?i)^(DELETE|UPDATE)\b.*\bWHERE (TRUE|1 ?= ?1)$`)
+	changeStatementPattern      = regexp.MustCompile(`(?i)^(DELETE|UPDATE)\b`)
+	whereClausePattern          = regexp.MustCompile(`(?i)\bWHERE\b`)
+)
+
+// isDestructiveStatement reports whether a DML statement changes every row of its table, which are those whose
+// condition is always true and, since only GoogleSQL requires a WHERE clause, PostgreSQL-dialect statements without one
+func isDestructiveStatement(sql string) bool {
+	sql = strings.TrimSuffix(sql, ";")
+	if isPostgresql() && changeStatementPattern.MatchString(sql) && !whereClausePattern.MatchString(sql) {
+		return true
+	}
+	return destructiveStatementPattern.MatchString(sql)
+}
+
+// parseMigrationDirectives reads the directive comments at the top of a migration, before its first statement, and
+// returns them along with the migration with the directive comments removed
+func parseMigrationDirectives(migration string) (map[string]string, string, error) {
+	directives := make(map[string]string)
+
+	lines := strings.Split(migration, "\n")
+	var body []string
+	inHeader := true
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if inHeader && trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+			inHeader = false
+		}
+		if !inHeader || !strings.HasPrefix(trimmed, migrationDirectivePrefix) {
+			body = append(body, line)
+			continue
+		}
+
+		for _, v := range strings.Split(strings.TrimPrefix(trimmed, migrationDirectivePrefix), ",") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			kv := strings.SplitN(v, "=", 2)
+			if len(kv) != 2 {
+				return nil, "", fmt.Errorf("directive %q is not of the form key=value", v)
+			}
+			k, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			if !knownMigrationDirectives[k] {
+				return nil, "", fmt.Errorf("unknown directive %q", k)
+			}
+			if _, ok := directives[k]; ok {
+				return nil, "", fmt.Errorf("duplicate directive %q", k)
+			}
+			directives[k] = val
+		}
+	}
+
+	return directives, strings.Join(body, "\n"), nil
+}
+
+// DIRECTIVES <--------------------------------------------------
+
+// ASSERTIONS >--------------------------------------------------
+
+// assertionExpectPrefix marks a comment giving the expected result of the query that follows it, e.g.
+// `-- expect: rows=3`, `-- expect: value=42` or `-- expect: true`, where a query without one must return true
+const assertionExpectPrefix = "-- expect:"
+
+// dmlAssertions maps each DML migration to its assertion files, as determined with the migrations
+var dmlAssertions map[string][]string
+
+// assertion is a query checked after the statements of a DML migration, in the same transaction
+type assertion struct {
+	file   string
+	sql    string
+	expect expectation
+}
+
+// expectation is the expected result of a query, either its number of rows compared with `op`, the value of its only
+// column of its only row, or that value being true
+type expectation struct {
+	rows  bool
+	op    string
+	count int64
+	value *string
+}
+
+type assertionError struct {
+	assertion assertion
+	message   string
+}
+
+func (e *assertionError) Error() string {
+	return fmt.Sprintf("assertion %q of %q expecting %s %s", e.assertion.sql, e.assertion.file, e.assertion.expect, e.message)
+}
+
+var expectRowsPattern = regexp.MustCompile(`^rows ?(=|!=|>=|<=|>|<) ?(\d+)$`)
+
+func parseExpectation(expect string) (expectation, error) {
+	expect = strings.TrimSpace(expect)
+	if expect == "true" {
+		return expectation{}, nil
+	}
+	if strings.HasPrefix(expect, "value=") {
+		v := strings.TrimPrefix(expect, "value=")
+		return expectation{value: &v}, nil
+	}
+	if m := expectRowsPattern.FindStringSubmatch(expect); m != nil {
+		count, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return expectation{}, fmt.Errorf("invalid row count in expectation %q: %v", expect, err)
+		}
+		return expectation{rows: true, op: m[1], count: count}, nil
+	}
+	return expectation{}, fmt.Errorf("invalid expectation %q, expected rows<op><count>, value=<value> or true", expect)
+}
+
+func (e expectation) String() string {
+	if e.rows {
+		return fmt.Sprintf("rows%s%d", e.op, e.count)
+	}
+	if e.value != nil {
+		return fmt.Sprintf("value=%s", *e.value)
+	}
+	return "true"
+}
+
+// matchesCount compares a number of rows with the expected number
+func (e expectation) matchesCount(count int64) bool {
+	switch e.op {
+	case "=":
+		return count == e.count
+	case "!=":
+		return count != e.count
+	case ">=":
+		return count >= e.count
+	case "<=":
+		return count <= e.count
+	case ">":
+		return count > e.count
+	case "<":
+		return count < e.count
+	}
+	return false
+}
+
+// readAssertions reads the queries of an assertion file, replacing tokens as in its DML migration
+func readAssertions(dir, file string, migrationData map[string]string) []assertion {
+	f := fmt.Sprintf("%s/%s", dir, file)
+	fileBytes, err := ioutil.ReadFile(f)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed reading assertion file %q: %v", f, err))
+	}
+	_, content, err := parseMigrationDirectives(string(fileBytes))
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed parsing directives in assertion file %q: %v", f, err))
+	}
+	for k, v := range migrationData {
+		content = strings.ReplaceAll(content, fmt.Sprintf("@%s@", k), v)
+	}
+
+	split, err := splitStatements(content)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed parsing assertion file %q: %v", f, err))
+	}
+	var assertions []assertion
+	for _, v := range split {
+		a := assertion{file: file, sql: v.sql}
+		if v.expect != nil {
+			a.expect = *v.expect
+		}
+		assertions = append(assertions, a)
+	}
+	logDebug(fmt.Sprintf("Read '%d' assertions from assertion file %q", len(assertions), f))
+	return assertions
+}
+
+// expectedStatement is a statement split from a migration or assertion file along with the expectation given in the
+// `-- expect:` comment before it, if any
+type expectedStatement struct {
+	sql    string
+	expect *expectation
+}
+
+// splitStatements splits SQL into its statements on semicolons outside of quoted strings and identifiers, dropping
+// `--` and `/* */` comments and collapsing white space, where an `-- expect:` comment applies to the statement that
+// follows it. PostgreSQL dollar-quoted strings and nested block comments are not recognized.
+func splitStatements(content string) ([]expectedStatement, error) {
+	var statements []expectedStatement
+	var expect *expectation
+	var b strings.Builder
+	flush := func() {
+		if sql := replaceWhiteSpaceWithSpace(b.String()); sql != "" {
+			statements = append(statements, expectedStatement{sql: sql, expect: expect})
+			expect = nil
+		}
+		b.Reset()
+	}
+	// quote is the delimiter of the quoted string or identifier a line starts or ends in, if any
+	var quote string
+	// comment is whether a line starts or ends in a block comment
+	var comment bool
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if quote == "" && !comment && strings.HasPrefix(trimmed, assertionExpectPrefix) {
+			if expect != nil {
+				return nil, fmt.Errorf("more than one expectation before statement: %q", trimmed)
+			}
+			e, err := parseExpectation(strings.TrimPrefix(trimmed, assertionExpectPrefix))
+			if err != nil {
+				return nil, err
+			}
+			expect = &e
+			continue
+		}
+		if quote == "" && !comment && strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		start := 0
+		for i := 0; i < len(line); i++ {
+			switch {
+			case comment:
+				if strings.HasPrefix(line[i:], "*/") {
+					i++
+					comment = false
+					start = i + 1
+				}
+			case quote != "" && line[i] == '\\' && !isPostgresql():
+				i++
+			case quote != "":
+				if strings.HasPrefix(line[i:], quote) {
+					i += len(quote) - 1
+					quote = ""
+				}
+			case line[i] == '\'' || line[i] == '"' || line[i] == '`':
+				quote = line[i : i+1]
+				if triple := strings.Repeat(quote, 3); quote != "`" && !isPostgresql() && strings.HasPrefix(line[i:], triple) {
+					quote = triple
+					i += 2
+				}
+			case line[i] == ';':
+				b.WriteString(line[start:i])
+				flush()
+				start = i + 1
+			case strings.HasPrefix(line[i:], "/*"):
+				b.WriteString(line[start:i])
+				b.WriteString(" ")
+				comment = true
+				i++
+			case strings.HasPrefix(line[i:], "--"):
+				// A comment at the end of a line would otherwise swallow the lines after it once white space is collapsed
+				if comment := line[i:]; strings.HasPrefix(comment, assertionExpectPrefix) {
+					return nil, fmt.Errorf("expectation %q must be on its own line before its statement", comment)
+				}
+				line = line[:i]
+			}
+		}
+		if !comment {
+			b.WriteString(line[start:])
+		}
+		b.WriteString("\n")
+	}
+	if quote != "" {
+		return nil, fmt.Errorf("unterminated quoted string or identifier starting with %s", quote)
+	}
+	if comment {
+		return nil, errors.New("unterminated block comment")
+	}
+	flush()
+	if expect != nil {
+		return nil, fmt.Errorf("expectation %s is not followed by a statement", expect)
+	}
+	return statements, nil
+}
+
+// checkRowCounts compares the row counts of the statements of a DML migration with those expected of them, returning
+// an assertionError for the first that does not match so that the transaction is rolled back
+func checkRowCounts(migration string, statements []spanner.Statement, expectations []*expectation, rowCounts []int64) error {
+	for i, v := range expectations {
+		if v == nil || i >= len(rowCounts) {
+			continue
+		}
+		if !v.matchesCount(rowCounts[i]) {
+			return &assertionError{assertion: assertion{file: migration, sql: statements[i].SQL, expect: *v}, message: fmt.Sprintf("updated '%d' rows", rowCounts[i])}
+		}
+	}
+	return nil
+}
+
+// checkAssertions runs the assertions in the transaction of a DML migration, returning an assertionError for the
+// first that fails so that the transaction is rolled back
+func checkAssertions(ctx context.Context, txn *spanner.ReadWriteTransaction, queryOptions spanner.QueryOptions, assertions []assertion) error {
+	for _, v := range assertions {
+		var rows [][]spanner.GenericColumnValue
+		err := txn.QueryWithOptions(ctx, spanner.Statement{SQL: v.sql}, queryOptions).Do(func(r *spanner.Row) error {
+			row := make([]spanner.GenericColumnValue, r.Size())
+			for i := range row {
+				if err := r.Column(i, &row[i]); err != nil {
+					return err
+				}
+			}
+			rows = append(rows, row)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if v.expect.rows {
+			if !v.expect.matchesCount(int64(len(rows))) {
+				return &assertionError{assertion: v, message: fmt.Sprintf("returned '%d' rows", len(rows))}
+			}
+		} else {
+			if len(rows) != 1 || len(rows[0]) != 1 {
+				return &assertionError{assertion: v, message: fmt.Sprintf("returned '%d' rows rather than a single value", len(rows))}
+			}
+			value := fmtColumnValue(rows[0][0])
+			if v.expect.value == nil && value != "true" || v.expect.value != nil && value != *v.expect.value {
+				return &assertionError{assertion: v, message: fmt.Sprintf("returned %s", value)}
+			}
+		}
+		logInfo(fmt.Sprintf("Passed assertion %q of %q expecting %s", v.sql, v.file, v.expect))
+	}
+	return nil
+}
+
+// fmtColumnValue formats a column value as written in an expectation, where NULL is NULL
+func fmtColumnValue(v spanner.GenericColumnValue) string {
+	switch k := v.Value.GetKind().(type) {
+	case *structpb.Value_NullValue:
+		return "NULL"
+	case *structpb.Value_StringValue:
+		return k.StringValue
+	case *structpb.Value_BoolValue:
+		return strconv.FormatBool(k.BoolValue)
+	case *structpb.Value_NumberValue:
+		return strconv.FormatFloat(k.NumberValue, 'g', -1, 64)
+	}
+	return v.Value.String()
+}
+
+// ASSERTIONS <--------------------------------------------------
+
+// BASELINE >--------------------------------------------------
+
+// baseline adopts an existing database by marking the given DDL and DML migration versions as applied without
+// running any migrations, refusing if there is already migration history unless forced
+func baseline(ctx context.Context, workingDir string, config *config) {
+	logDebug(fmt.Sprintf("Checking args"))
+	if err := checkArgs(); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed checking required command line arguments: %v", err))
+	}
+	if baselineDdlVersion < 0 || baselineDmlVersion < 0 || baselineDdlVersion+baselineDmlVersion == 0 {
+		logFatal(errConfiguration, "Command line arguments `ddl_version` and `dml_version` cannot be negative and at least one must be given")
+	}
+	logDebug(fmt.Sprintf("Checked args"))
+
+	dir := singleStream(workingDir, config).Dir
+
+	databseConnection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
+
+	spannerClient, spannerAdminClient := newSpannerClient(ctx, databseConnection)
+	defer spannerClient.Close()
+	defer spannerAdminClient.Close()
+
+	detectDialect(ctx, spannerAdminClient, databseConnection)
+
+	if useHistory {
+		environments := loadEnvironments(config)
+		if err := environments.checkEnvironment(envId); err != nil {
+			logFatal(errConfiguration, fmt.Sprintf("Failed checking command line argument `env_id`: %v", err))
+		}
+		ddl, dml := determineMigrations(dir, environments)
+		baselineHistory(ctx, spannerClient, spannerAdminClient, databseConnection, legacyAppliedMigrations(ddl, dml, baselineDdlVersion, baselineDmlVersion))
+		return
+	}
+
+	createMigrationTableIfNecessary(ctx, spannerAdminClient, databseConnection, schemaMigrationsTable)
+	createMigrationTableIfNecessary(ctx, spannerAdminClient, databseConnection, dataMigrationsTable)
+
+	logInfo(fmt.Sprintf("Baselining database %q at DDL migration version '%d' and DML migration version '%d'", databseConnection, baselineDdlVersion, baselineDmlVersion))
+
+	_, err := spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		var mutations []*spanner.Mutation
+		for table, version := range map[string]int64{schemaMigrationsTable: baselineDdlVersion, dataMigrationsTable: baselineDmlVersion} {
+			stmt := dialectStatement(fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
+			var count int64
+			if err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+				return row.Columns(&count)
+			}); err != nil {
+				return err
+			}
+			if count > 0 {
+				if !force {
+					return &migratexError{category: errInconsistentState, message: fmt.Sprintf("Table %q already has migration history, use `-force` to replace it", table)}
+				}
+				logWarn(fmt.Sprintf("Replacing the migration history in table %q", table))
+				mutations = append(mutations, spanner.Delete(dialectIdentifier(table), spanner.AllKeys()))
+			}
+			if version > 0 {
+				mutations = append(mutations, spanner.Insert(dialectIdentifier(table), []string{dialectIdentifier("Version"), dialectIdentifier("Dirty")}, []interface{}{version, false}))
+			}
+		}
+		return txn.BufferWrite(mutations)
+	})
+	var e *migratexError
+	if errors.As(err, &e) {
+		logFatal(e.category, e.message)
+	}
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errDml), fmt.Sprintf("Failed baselining database %q: %v", databseConnection, err))
+	}
+
+	logInfo(fmt.Sprintf("Baselined database %q at DDL migration version '%d' and DML migration version '%d'", databseConnection, baselineDdlVersion, baselineDmlVersion))
+}
+
+// baselineHistory records the available migrations up to the baseline versions as applied in the migration history,
+// since the history only tracks the migrations it has a row for
+func baselineHistory(ctx context.Context, spannerClient *spanner.Client, spannerAdminClient *database.DatabaseAdminClient, databseConnection string, history []appliedMigration) {
+	if len(history) == 0 {
+		logFatal(errDiscovery, fmt.Sprintf("Found no available migrations up to DDL migration version '%d' and DML migration version '%d' to record in table %q", baselineDdlVersion, baselineDmlVersion, migrationHistoryTable))
+	}
+
+	createMigrationTableIfNecessary(ctx, spannerAdminClient, databseConnection, migrationHistoryTable)
+
+	logInfo(fmt.Sprintf("Baselining database %q at DDL migration version '%d' and DML migration version '%d' with '%d' applied migrations in table %q", databseConnection, baselineDdlVersion, baselineDmlVersion, len(history), migrationHistoryTable))
+
+	_, err := spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		var mutations []*spanner.Mutation
+		stmt := dialectStatement(fmt.Sprintf("SELECT COUNT(*) FROM %s", migrationHistoryTable))
+		var count int64
+		if err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+			return row.Columns(&count)
+		}); err != nil {
+			return err
+		}
+		if count > 0 {
+			if !force {
+				return &migratexError{category: errInconsistentState, message: fmt.Sprintf("Table %q already has migration history, use `-force` to replace it", migrationHistoryTable)}
+			}
+			logWarn(fmt.Sprintf("Replacing the migration history in table %q", migrationHistoryTable))
+			mutations = append(mutations, spanner.Delete(dialectIdentifier(migrationHistoryTable), spanner.AllKeys()))
+		}
+		return txn.BufferWrite(append(mutations, appliedMigrationMutations(history)...))
+	})
+	var e *migratexError
+	if errors.As(err, &e) {
+		logFatal(e.category, e.message)
+	}
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errDml), fmt.Sprintf("Failed baselining database %q: %v", databseConnection, err))
+	}
+
+	logInfo(fmt.Sprintf("Baselined database %q with '%d' applied migrations in table %q", databseConnection, len(history), migrationHistoryTable))
+}
+
+// BASELINE <--------------------------------------------------
+
+// STATUS >--------------------------------------------------
+
+const (
+	statusApplied     = "applied"
+	statusDirty       = "dirty"
+	statusPending     = "pending"
+	statusOutOfOrder  = "out of order"
+	statusUnavailable = "unavailable"
+)
+
+// migrationStatus is the state of an available or applied migration
+type migrationStatus struct {
+	revision int64
+	kind     string
+	name     string
+	state    string
+}
+
+// showStatus logs the state of every available and applied migration of each stream, computed from the migration history
+// or otherwise from SchemaMigrations and DataMigrations, without changing the database
+func showStatus(ctx context.Context, workingDir string, config *config) {
+	logDebug(fmt.Sprintf("Checking args"))
+	if err := checkArgs(); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed checking required command line arguments: %v", err))
+	}
+	logDebug(fmt.Sprintf("Checked args"))
+
+	databseConnection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
+
+	spannerClient, spannerAdminClient := newSpannerClient(ctx, databseConnection)
+	defer spannerClient.Close()
+	defer spannerAdminClient.Close()
+
+	detectDialect(ctx, spannerAdminClient, databseConnection)
+
+	environments := loadEnvironments(config)
+	if err := environments.checkEnvironment(envId); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed checking command line argument `env_id`: %v", err))
+	}
+
+	for _, v := range migrationStreams(workingDir, config) {
+		setStream(v.Name)
+		ddl, dml := determineMigrations(v.Dir, environments)
+		history := statusHistory(ctx, spannerClient, ddl, dml)
+		logMigrationStatuses(migrationStatuses(append(append([]string(nil), ddl...), dml...), history))
+	}
+}
+
+// statusHistory returns the applied migrations of the stream from the migration history, if it has any, otherwise
+// those SchemaMigrations and DataMigrations imply were applied, where the last version of a dirty table is dirty
+func statusHistory(ctx context.Context, spannerClient *spanner.Client, availableDdlMigrations, availableDmlMigrations []string) []appliedMigration {
+	if useHistory && tableExists(ctx, spannerClient, migrationHistoryTable) {
+		if history := readMigrationHistory(ctx, spannerClient); len(history) > 0 {
+			return history
+		}
+	}
+
+	var dirty [2]bool
+	var lastMigrations [2]int64
+	for i, table := range []string{schemaMigrationsTable, dataMigrationsTable} {
+		if tableExists(ctx, spannerClient, table) {
+			dirty[i], lastMigrations[i] = determineLastMigration(ctx, spannerClient, table)
+		}
+	}
+	history := legacyAppliedMigrations(availableDdlMigrations, availableDmlMigrations, lastMigrations[0], lastMigrations[1])
+	for i, v := range history {
+		if v.kind == "ddl" {
+			history[i].dirty = dirty[0] && v.revision == lastMigrations[0]
+		} else {
+			history[i].dirty = dirty[1] && v.revision == lastMigrations[1]
+		}
+	}
+	return history
+}
+
+// migrationStatuses returns the state of each available migration and each applied migration that is no longer
+// available, such as squashed migrations, in the order they are applied in. An available migration with no row in the
+// history is pending, or out of order if it comes before the last applied migration.
+func migrationStatuses(availableMigrations []string, history []appliedMigration) []migrationStatus {
+	applied := make(map[string]appliedMigration)
+	for _, v := range history {
+		applied[v.key()] = v
+	}
+
+	migrations := append([]string(nil), availableMigrations...)
+	sortMigrations(migrations)
+
+	var statuses []migrationStatus
+	for _, v := range migrations {
+		revision, err := migrationVersion(v)
+		if err != nil {
+			logFatal(errDiscovery, fmt.Sprintf("Failed determining migration version from file name %q: %v", v, err))
+		}
+		m := migrationStatus{revision: revision, kind: migrationKind(v), name: v, state: statusPending}
+		key := appliedMigration{revision: revision, kind: m.kind}.key()
+		if h, ok := applied[key]; ok {
+			m.state = statusApplied
+			if h.dirty {
+				m.state = statusDirty
+			}
+			delete(applied, key)
+		} else if len(history) > 0 {
+			last := history[len(history)-1]
+			if revision < last.revision || revision == last.revision && m.kind < last.kind {
+				m.state = statusOutOfOrder
+			}
+		}
+		statuses = append(statuses, m)
+	}
+	for _, v := range history {
+		if _, ok := applied[v.key()]; ok {
+			statuses = append(statuses, migrationStatus{revision: v.revision, kind: v.kind, name: v.name, state: statusUnavailable})
+		}
+	}
+
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if statuses[i].revision != statuses[j].revision {
+			return statuses[i].revision < statuses[j].revision
+		}
+		return statuses[i].kind < statuses[j].kind
+	})
+	return statuses
+}
+
+func logMigrationStatuses(statuses []migrationStatus) {
+	counts := make(map[string]int)
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REVISION\tKIND\tSTATE\tNAME")
+	for _, v := range statuses {
+		counts[v.state]++
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", v.revision, v.kind, v.state, v.name)
+	}
+	w.Flush()
+
+	summary := fmt.Sprintf("'%d' applied, '%d' dirty, '%d' pending, '%d' out of order and '%d' unavailable migrations", counts[statusApplied], counts[statusDirty], counts[statusPending], counts[statusOutOfOrder], counts[statusUnavailable])
+	if migrationStream != "" {
+		logInfo(fmt.Sprintf("Status of stream %q with %s:\n%s", migrationStream, summary, b.String()))
+	} else {
+		logInfo(fmt.Sprintf("Status with %s:\n%s", summary, b.String()))
+	}
+}
+
+// STATUS <--------------------------------------------------
+
+// SQUASH >--------------------------------------------------
+
+// squash replaces the migrations up to and including a revision with a single baseline DDL migration of that
+// revision, generated from the schema of a database at that revision. Databases already at or past the revision skip
+// the baseline while new databases apply it instead of every squashed migration. The squashed migrations, including DML
+// migrations since they would otherwise be applied before the tables they need exist, are moved to the archive
+// directory where 'migrate' and migratex no longer find them.
+func squash(ctx context.Context, workingDir string) {
+	logDebug(fmt.Sprintf("Checking args"))
+	if err := checkArgs(); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed checking required command line arguments: %v", err))
+	}
+	if squashUpto <= 0 {
+		logFatal(errConfiguration, "Missing command line argument `upto`")
+	}
+	logDebug(fmt.Sprintf("Checked args"))
+
+	squashed, prefix := squashedMigrations(workingDir, squashUpto)
+	hasDdl := false
+	for _, v := range squashed {
+		hasDdl = hasDdl || strings.HasSuffix(v, ".ddl.up.sql")
+	}
+	if !hasDdl {
+		logFatal(errDiscovery, fmt.Sprintf("Found no DDL migrations up to revision '%d' to squash", squashUpto))
+	}
+	logInfo(fmt.Sprintf("Squashing '%d' migration files up to revision '%d': %v", len(squashed), squashUpto, squashed))
+
+	databseConnection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
+
+	spannerClient, spannerAdminClient := newSpannerClient(ctx, databseConnection)
+	defer spannerClient.Close()
+	defer spannerAdminClient.Close()
+
+	dirty, lastDdlMigration := lastAppliedMigration(ctx, spannerClient, "ddl")
+	if dirty {
+		logFatal(errDirtyState, fmt.Sprintf("%s table is dirty, this must be manually fixed before its schema can be squashed", trackingTable("ddl")))
+	}
+	if lastDdlMigration != squashUpto {
+		logFatal(errInconsistentState, fmt.Sprintf("Database %q is at DDL migration version '%d' but must be at version '%d' for its schema to be squashed", databseConnection, lastDdlMigration, squashUpto))
+	}
+
+	statements := schemaStatements(ctx, spannerAdminClient, databseConnection)
+
+	archive := filepath.Join(workingDir, archiveDir)
+	if err := os.MkdirAll(archive, 0755); err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed creating archive directory %q: %v", archive, err))
+	}
+	for _, v := range squashed {
+		if _, err := os.Stat(filepath.Join(archive, v)); err == nil {
+			logFatal(errDiscovery, fmt.Sprintf("Migration %q has already been archived in %q", v, archive))
+		}
+	}
+	for _, v := range squashed {
+		if err := os.Rename(filepath.Join(workingDir, v), filepath.Join(archive, v)); err != nil {
+			logFatal(errDiscovery, fmt.Sprintf("Failed archiving migration %q in %q: %v", v, archive, err))
+		}
+		logDebug(fmt.Sprintf("Archived migration %q in %q", v, archive))
+		if strings.HasSuffix(v, ".dml.sql") {
+			logWarn(fmt.Sprintf("Archived DML migration %q will not be applied to new databases, copy any data it loads that new databases need into a new DML migration", v))
+		}
+	}
+
+	f := filepath.Join(workingDir, fmt.Sprintf("%s_baseline.ddl.up.sql", prefix))
+	content := fmt.Sprintf("-- Generated by migratex squash from the migrations up to revision %d, archived in %s\n\n%s", squashUpto, archiveDir, formatSchema(statements))
+	if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed writing baseline DDL migration %q: %v", f, err))
+	}
+
+	logInfo(fmt.Sprintf("Squashed '%d' migration files up to revision '%d' into %q, only squash revisions every environment has already reached", len(squashed), squashUpto, f))
+}
+
+// squashedMigrations finds the migration files, of any kind and for any environment, up to and including a revision
+// and returns them along with the file name prefix of the revision, keeping any zero padding
+func squashedMigrations(dir string, upto int64) ([]string, string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed reading files in directory %q: %v", dir, err))
+	}
+
+	prefix := strconv.FormatInt(upto, 10)
+	var squashed []string
+	for _, v := range files {
+		name := v.Name()
+		if v.IsDir() || !(strings.HasSuffix(name, ".sql") || strings.HasSuffix(name, ".dml.json")) {
+			continue
+		}
+		version, err := migrationVersion(name)
+		if err != nil || version > upto {
+			continue
+		}
+		squashed = append(squashed, name)
+		if p := strings.Split(name, "_")[0]; len(p) > len(prefix) {
+			prefix = fmt.Sprintf("%0*d", len(p), upto)
+		}
+	}
+	return squashed, prefix
+}
+
+// schemaStatements returns the DDL statements of a database excluding the migration tracking tables
+func schemaStatements(ctx context.Context, spannerAdminClient *database.DatabaseAdminClient, databseConnection string) []string {
+	resp, err := spannerAdminClient.GetDatabaseDdl(ctx, &adminpb.GetDatabaseDdlRequest{Database: databseConnection})
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errUnexpected), fmt.Sprintf("Failed getting the schema of database %q: %v", databseConnection, err))
+	}
+
+	var statements []string
+	for _, v := range resp.Statements {
+		if isMigrationTableDdl(v) {
+			continue
+		}
+		statements = append(statements, v)
+	}
+	return statements
+}
+
+// migrationTableDdlPattern matches the creation of the migration tracking tables of any stream, where
+// PostgreSQL-dialect databases return unquoted identifiers in lower case
+var migrationTableDdlPattern = regexp.MustCompile(`(?i)^CREATE TABLE (SchemaMigrations|DataMigrations|MigrationHistory|RepeatableMigrations)(_[A-Za-z0-9_]+)? ?\(`)
+
+func isMigrationTableDdl(statement string) bool {
+	return migrationTableDdlPattern.MatchString(statement)
+}
+
+// SQUASH <--------------------------------------------------
+
+// SCHEMA >--------------------------------------------------
+
+const defaultSchemaFile = "schema.sql"
+
+// dumpDatabaseSchema writes the schema of the database to the schema file or, when checking, fails if the schema file
+// differs from it, so that the schema file committed alongside the migrations always describes their result
+func dumpDatabaseSchema(ctx context.Context, workingDir string) {
+	ctx, span := startSpan(ctx, "dumpSchema")
+	defer endSpan(span)
+
+	databseConnection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
+
+	spannerClient, spannerAdminClient := newSpannerClient(ctx, databseConnection)
+	defer spannerClient.Close()
+	defer spannerAdminClient.Close()
+
+	f := schemaFile
+	if !filepath.IsAbs(f) {
+		f = filepath.Join(workingDir, f)
+	}
+	schema := formatSchema(schemaStatements(ctx, spannerAdminClient, databseConnection))
+
+	if !checkSchema {
+		if err := ioutil.WriteFile(f, []byte(schema), 0644); err != nil {
+			logFatal(errDiscovery, fmt.Sprintf("Failed writing schema file %q: %v", f, err))
+		}
+		logInfo(fmt.Sprintf("Dumped schema of database %q to %q", databseConnection, f))
+		return
+	}
+
+	fileBytes, err := ioutil.ReadFile(f)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed reading schema file %q: %v", f, err))
+	}
+	if string(fileBytes) == schema {
+		logInfo(fmt.Sprintf("Schema file %q matches the schema of database %q", f, databseConnection))
+		return
+	}
+	expected, err := splitSchema(string(fileBytes))
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed splitting schema file %q into statements: %v", f, err))
+	}
+	actual, err := splitSchema(schema)
+	if err != nil {
+		logFatal(errUnexpected, fmt.Sprintf("Failed splitting schema of database %q into statements: %v", databseConnection, err))
+	}
+	missing, extra := diffStatements(expected, actual)
+	for _, v := range missing {
+		logError(fmt.Sprintf("Schema file %q has statement not in database: %s", f, v))
+	}
+	for _, v := range extra {
+		logError(fmt.Sprintf("Database has statement not in schema file %q: %s", f, v))
+	}
+	logFatal(errSchemaDrift, fmt.Sprintf("Schema file %q differs from the schema of database %q, run dump-schema to update it", f, databseConnection))
+}
+
+// formatSchema formats DDL statements as a SQL file, one statement per paragraph in the order returned by spanner,
+// which creates parents before their children, with trailing white space removed from every line
+func formatSchema(statements []string) string {
+	var b strings.Builder
+	for _, v := range statements {
+		lines := strings.Split(strings.TrimSpace(strings.ReplaceAll(v, "\r\n", "\n")), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(line, " \t")
+		}
+		b.WriteString(strings.Join(lines, "\n"))
+		b.WriteString(";\n\n")
+	}
+	return b.String()
+}
+
+// splitSchema splits a schema file or DDL migration into its statements the same way as other migrations, ignoring
+// comments
+func splitSchema(schema string) ([]string, error) {
+	split, err := splitStatements(schema)
+	if err != nil {
+		return nil, err
+	}
+	var statements []string
+	for _, v := range split {
+		statements = append(statements, v.sql)
+	}
+	return statements, nil
+}
+
+// diffStatements returns the statements only in expected and those only in actual
+func diffStatements(expected []string, actual []string) ([]string, []string) {
+	inActual := make(map[string]bool)
+	for _, v := range actual {
+		inActual[v] = true
+	}
+	inExpected := make(map[string]bool)
+	var missing []string
+	for _, v := range expected {
+		inExpected[v] = true
+		if !inActual[v] {
+			missing = append(missing, v)
+		}
+	}
+	var extra []string
+	for _, v := range actual {
+		if !inExpected[v] {
+			extra = append(extra, v)
+		}
+	}
+	return missing, extra
+}
+
+// SCHEMA <--------------------------------------------------
+
+// DRIFT >--------------------------------------------------
+
+const (
+	expectedSchemaSnapshot = "snapshot"
+	expectedSchemaEmulator = "emulator"
+)
+
+// schemaObject is a table, column, index, constraint or other object of a schema, where the definition of a table
+// excludes its columns and constraints so that each is compared on its own
+type schemaObject struct {
+	kind       string
+	name       string
+	table      string
+	definition string
+}
+
+func (o schemaObject) key() string {
+	return o.kind + " " + o.name
+}
+
+var (
+	createTablePattern    = regexp.MustCompile(`(?i)^CREATE TABLE (\S+?) ?\((.*)$`)
+	createIndexPattern    = regexp.MustCompile(`(?i)^CREATE (?:UNIQUE |NULL_FILTERED |SEARCH |VECTOR )*INDEX (\S+) ON (\S+?) ?\(`)
+	addConstraintPattern  = regexp.MustCompile(`(?i)^ALTER TABLE (\S+) ADD CONSTRAINT (\S+) (.*)$`)
+	createOtherPattern    = regexp.MustCompile(`(?i)^CREATE (?:OR REPLACE )?(VIEW|CHANGE STREAM|SEQUENCE|ROLE|MODEL|SCHEMA|PROTO BUNDLE) (\S+)`)
+	namedConstraintPrefix = regexp.MustCompile(`(?i)^CONSTRAINT (\S+) `)
+)
+
+// drift compares the schema of the database object by object with the schema its migrations describe, taken from the
+// schema file or by replaying the applied DDL migrations into the emulator, and fails if they differ
+func drift(ctx context.Context, workingDir string, config *config) {
+	logDebug(fmt.Sprintf("Checking args"))
+	if err := checkArgs(); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed checking required command line arguments: %v", err))
+	}
+	if expectedSchema != expectedSchemaSnapshot && expectedSchema != expectedSchemaEmulator {
+		logFatal(errConfiguration, fmt.Sprintf("Invalid command line argument `expected` %q, must be %q or %q", expectedSchema, expectedSchemaSnapshot, expectedSchemaEmulator))
+	}
+	logDebug(fmt.Sprintf("Checked args"))
+
+	databseConnection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
+
+	spannerClient, spannerAdminClient := newSpannerClient(ctx, databseConnection)
+	defer spannerClient.Close()
+	defer spannerAdminClient.Close()
+
+	// The emulator database the DDL migrations are replayed into has the dialect of the database
+	detectDialect(ctx, spannerAdminClient, databseConnection)
+
+	var expected []string
+	if expectedSchema == expectedSchemaSnapshot {
+		f := schemaFile
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(workingDir, f)
+		}
+		fileBytes, err := ioutil.ReadFile(f)
+		if err != nil {
+			logFatal(errDiscovery, fmt.Sprintf("Failed reading schema file %q: %v", f, err))
+		}
+		if expected, err = splitSchema(string(fileBytes)); err != nil {
+			logFatal(errDiscovery, fmt.Sprintf("Failed splitting schema file %q into statements: %v", f, err))
+		}
+		logInfo(fmt.Sprintf("Read expected schema from schema file %q", f))
+	} else {
+		// The schema of the database is that of every stream, whichever one the `stream` command line argument selects
+		var ddl []string
+		for _, v := range configuredStreams(workingDir, config) {
+			setStream(v.Name)
+			dirty, lastDdlMigration := lastAppliedMigration(ctx, spannerClient, "ddl")
+			if dirty {
+				logFatal(errDirtyState, fmt.Sprintf("%s table is dirty, this must be manually fixed before its schema can be compared", trackingTable("ddl")))
+			}
+			applied := func(version int64) bool {
+				return version <= lastDdlMigration
+			}
+			if useHistory {
+				// Migrations applied out of order can leave older revisions unapplied, so only those in the history were applied
+				revisions := appliedRevisions(ctx, spannerClient, "ddl")
+				applied = func(version int64) bool {
+					return revisions[version]
+				}
+			}
+			ddl = append(ddl, appliedDdlMigrations(v.Dir, applied)...)
+			ddl = append(ddl, appliedRepeatableMigrations(ctx, spannerClient, v.Dir)...)
+		}
+		expected = replayDdlMigrations(ctx, ddl)
+	}
+
+	actual := schemaStatements(ctx, spannerAdminClient, databseConnection)
+
+	differences := diffSchemaObjects(parseSchemaObjects(expected), parseSchemaObjects(actual))
+	if len(differences) == 0 {
+		logInfo(fmt.Sprintf("Schema of database %q matches the %s schema", databseConnection, expectedSchema))
+		return
+	}
+	for _, v := range differences {
+		logError(v)
+	}
+	logFatal(errSchemaDrift, fmt.Sprintf("Schema of database %q has drifted from the %s schema with '%d' differences", databseConnection, expectedSchema, len(differences)))
+}
+
+// appliedDdlMigrations returns the paths of the applied DDL migrations in a directory
+func appliedDdlMigrations(dir string, applied func(version int64) bool) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logFatal(errDiscovery, fmt.Sprintf("Failed reading files in directory %q: %v", dir, err))
+	}
+	var ddl []string
+	for _, v := range files {
+		if !strings.HasSuffix(v.Name(), ".ddl.up.sql") {
+			continue
+		}
+		if version, err := migrationVersion(v.Name()); err == nil && applied(version) {
+			ddl = append(ddl, v.Name())
+		}
+	}
+	sortMigrations(ddl)
+
+	paths := make([]string, len(ddl))
+	for i, v := range ddl {
+		paths[i] = filepath.Join(dir, v)
+	}
+	return paths
+}
+
+// replayDdlMigrations applies DDL migrations in order to a new database in the emulator and returns its schema,
+// dropping the database afterwards
+func replayDdlMigrations(ctx context.Context, ddl []string) []string {
+	emulatorDatabase := createEmulatorDatabase(ctx, "drift")
+	defer dropEmulatorDatabase(emulatorDatabase)
+
+	logInfo(fmt.Sprintf("Replaying '%d' DDL migrations into emulator database %q", len(ddl), emulatorDatabase.connection))
+	for _, v := range ddl {
+		fileBytes, err := ioutil.ReadFile(v)
+		if err != nil {
+			logFatal(errDiscovery, fmt.Sprintf("Failed reading DDL migration %q: %v", v, err))
+		}
+		statements, err := splitSchema(string(fileBytes))
+		if err != nil {
+			logFatal(errDiscovery, fmt.Sprintf("Failed splitting DDL migration %q into statements: %v", v, err))
+		}
+		if len(statements) == 0 {
+			continue
+		}
+		op, err := emulatorDatabase.adminClient.UpdateDatabaseDdl(ctx, &adminpb.UpdateDatabaseDdlRequest{Database: emulatorDatabase.connection, Statements: statements})
+		if err == nil {
+			err = op.Wait(ctx)
+		}
+		if err != nil {
+			logFatal(spannerErrorCategory(err, errDdl), fmt.Sprintf("Failed replaying DDL migration %q into emulator database %q: %v", v, emulatorDatabase.connection, err))
+		}
+		logDebug(fmt.Sprintf("Replayed DDL migration %q", v))
+	}
+
+	return schemaStatements(ctx, emulatorDatabase.adminClient, emulatorDatabase.connection)
+}
+
+// parseSchemaObjects parses DDL statements into the objects they create, where statements that are not understood are
+// objects of their own
+func parseSchemaObjects(statements []string) []schemaObject {
+	var objects []schemaObject
+	for _, v := range statements {
+		statement := replaceWhiteSpaceWithSpace(v)
+
+		if m := createTablePattern.FindStringSubmatch(statement); m != nil {
+			table := unquoteIdentifier(m[1])
+			elements, options := splitTableDefinition(m[2])
+			objects = append(objects, schemaObject{kind: "table", name: table, definition: options})
+			tableIndex := len(objects) - 1
+			for _, e := range elements {
+				if strings.HasPrefix(strings.ToUpper(e), "PRIMARY KEY") {
+					// PostgreSQL-dialect tables declare their primary key with their columns
+					objects[tableIndex].definition = strings.TrimSpace(e + " " + objects[tableIndex].definition)
+				} else if c := namedConstraintPrefix.FindStringSubmatch(e); c != nil {
+					objects = append(objects, schemaObject{kind: "constraint", name: table + "." + unquoteIdentifier(c[1]), table: table, definition: e[len(c[0]):]})
+				} else if u := strings.ToUpper(e); strings.HasPrefix(u, "FOREIGN KEY") || strings.HasPrefix(u, "CHECK") {
+					objects = append(objects, schemaObject{kind: "constraint", name: table + "." + e, table: table, definition: e})
+				} else {
+					column := strings.SplitN(e, " ", 2)
+					objects = append(objects, schemaObject{kind: "column", name: table + "." + unquoteIdentifier(column[0]), table: table, definition: strings.Join(column[1:], " ")})
+				}
+			}
+
+		} else if m := createIndexPattern.FindStringSubmatch(statement); m != nil {
+			objects = append(objects, schemaObject{kind: "index", name: unquoteIdentifier(m[1]), table: unquoteIdentifier(m[2]), definition: statement})
+
+		} else if m := addConstraintPattern.FindStringSubmatch(statement); m != nil {
+			table := unquoteIdentifier(m[1])
+			objects = append(objects, schemaObject{kind: "constraint", name: table + "." + unquoteIdentifier(m[2]), table: table, definition: m[3]})
+
+		} else if m := createOtherPattern.FindStringSubmatch(statement); m != nil {
+			objects = append(objects, schemaObject{kind: strings.ToLower(m[1]), name: unquoteIdentifier(m[2]), definition: statement})
+
+		} else {
+			objects = append(objects, schemaObject{kind: "statement", name: statement, definition: statement})
+		}
+	}
+	return objects
+}
+
+// splitTableDefinition splits what follows the opening parenthesis of a CREATE TABLE statement into its column and
+// constraint definitions and the table options after the closing parenthesis, such as its primary key
+func splitTableDefinition(definition string) ([]string, string) {
+	var elements []string
+	depth := 0
+	start := 0
+	for i, r := range definition {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				if e := strings.TrimSpace(definition[start:i]); e != "" {
+					elements = append(elements, e)
+				}
+				return elements, strings.TrimSpace(definition[i+1:])
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				if e := strings.TrimSpace(definition[start:i]); e != "" {
+					elements = append(elements, e)
+				}
+				start = i + 1
+			}
+		}
+	}
+	return elements, ""
+}
+
+func unquoteIdentifier(identifier string) string {
+	return strings.Trim(identifier, "`\"")
+}
+
+// diffSchemaObjects describes the objects missing from, extra in and altered in the actual schema, where the columns
+// and constraints of a missing or extra table are not described separately
+func diffSchemaObjects(expected []schemaObject, actual []schemaObject) []string {
+	expectedObjects := make(map[string]schemaObject)
+	for _, v := range expected {
+		expectedObjects[v.key()] = v
+	}
+	actualObjects := make(map[string]schemaObject)
+	for _, v := range actual {
+		actualObjects[v.key()] = v
+	}
+	missingTables := make(map[string]bool)
+	extraTables := make(map[string]bool)
+
+	var differences []string
+	for _, v := range expected {
+		a, ok := actualObjects[v.key()]
+		if !ok {
+			if v.kind == "table" {
+				missingTables[v.name] = true
+			}
+			if !missingTables[v.table] {
+				differences = append(differences, fmt.Sprintf("Missing %s %q: %s", v.kind, v.name, v.definition))
+			}
+		} else if a.definition != v.definition {
+			differences = append(differences, fmt.Sprintf("Altered %s %q: expected %s but found %s", v.kind, v.name, v.definition, a.definition))
+		}
+	}
+	for _, v := range actual {
+		if _, ok := expectedObjects[v.key()]; ok {
+			continue
+		}
+		if v.kind == "table" {
+			extraTables[v.name] = true
+		}
+		if !extraTables[v.table] {
+			differences = append(differences, fmt.Sprintf("Extra %s %q: %s", v.kind, v.name, v.definition))
+		}
+	}
+	return differences
+}
+
+// DRIFT <--------------------------------------------------
+
+// VERIFY >--------------------------------------------------
+
+// verify applies every migration of an environment, or of every declared environment in turn, to a new database in the
+// emulator, so that migrations can be checked without access to any real database
+func verify(ctx context.Context, workingDir string, config *config) {
+	if !verifyAllEnvs {
+		verifyEnvironment(ctx, workingDir, config)
+		return
+	}
+
+	environments := loadEnvironments(config)
+	if !environments.declared() {
+		logFatal(errConfiguration, "No environments are declared to verify, declare them in the config file or give `env_id`")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		logFatal(errUnexpected, fmt.Sprintf("Failed determining the migratex executable: %v", err))
+	}
+
+	var failed []string
+	category := errUnexpected
+	for i, env := range environments.Environments {
+		if ctx.Err() != nil {
+			logFatal(errInterrupted, fmt.Sprintf("Interrupted before verifying envs %v", environments.Environments[i:]))
+		}
+
+		// Only flags given on the command line are passed on, so each process resolves the rest from its own environment
+		// variables and the environment in the config file like any other run
+		args := append([]string{commandVerify, "-env_id", env}, commandLineArgs("config", "token_file", "timeout", "log_format", "log_level", "log_env_allowlist", "emulator_host", "database_dialect", "stream", "history")...)
+
+		cmd := exec.CommandContext(ctx, executable, args...)
+		cmd.Cancel = func() error {
+			return cmd.Process.Signal(os.Interrupt)
+		}
+		cmd.Dir = workingDir
+		cmd.Env = append(os.Environ(), fmt.Sprintf("%sRUN_ID=%s", configEnvVarPrefix, l.runId))
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		logInfo(fmt.Sprintf("Verifying migrations of env %q", env))
+		if err := cmd.Run(); err != nil {
+			logError(fmt.Sprintf("Failed verifying migrations of env %q: %v", env, err))
+			if len(failed) == 0 {
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					category = exitCodeErrorCategory(exitErr.ExitCode())
+				}
+			}
+			failed = append(failed, env)
+		}
+	}
+
+	if len(failed) > 0 {
+		logFatal(category, fmt.Sprintf("Failed verifying migrations of envs %v", failed))
+	}
+	logInfo(fmt.Sprintf("Verified migrations of envs %v", environments.Environments))
+}
+
+// commandLineArgs returns the flags of the given names that were set on the command line, with their values
+func commandLineArgs(names ...string) []string {
+	var args []string
+	for _, v := range names {
+		if value, ok := commandLineFlags[v]; ok {
+			args = append(args, fmt.Sprintf("-%s=%s", v, value))
+		}
+	}
+	return args
+}
+
+// verifyEnvironment applies every migration of the environment to a new emulator database, dropping it afterwards
+func verifyEnvironment(ctx context.Context, workingDir string, config *config) {
+	if envId == "" {
+		logFatal(errConfiguration, "Missing command line argument `env_id` or `all_envs`")
+	}
+
+	environments := loadEnvironments(config)
+	if err := environments.checkEnvironment(envId); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed checking command line argument `env_id`: %v", err))
+	}
+
+	emulatorDatabase := createEmulatorDatabase(ctx, "verify")
+	defer dropEmulatorDatabase(emulatorDatabase)
+	spannerDatabaseId = emulatorDatabase.id
+
+	report = newRunReport()
+	defer func() {
+		r := recover()
+		report.finish(r)
+		writeReports()
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	// Hooks act on real environments, such as pausing their consumers, so are not run
+	runHooks = newHooks(nil)
+
+	logInfo(fmt.Sprintf("Verifying migrations of env %q in emulator database %q", envId, emulatorDatabase.connection))
+
+	spannerClient, spannerAdminClient := newSpannerClient(ctx, emulatorDatabase.connection)
+	defer spannerClient.Close()
+	defer spannerAdminClient.Close()
+
+	detectDialect(ctx, spannerAdminClient, emulatorDatabase.connection)
+
+	var ddlCount, dmlCount int
+	for _, v := range migrationStreams(workingDir, config) {
+		setStream(v.Name)
+		report.versions(0, 0)
+		ddl, dml := determineMigrations(v.Dir, environments)
+		if len(ddl) == 0 && len(dml) == 0 {
+			logInfo(fmt.Sprintf("No migrations found in directory %q", v.Dir))
+			applyRepeatableMigrations(ctx, spannerClient, spannerAdminClient, v.Dir)
+			continue
+		}
+
+		if useHistory {
+			createMigrationTableIfNecessary(ctx, spannerAdminClient, emulatorDatabase.connection, migrationHistoryTable)
+		} else {
+			createMigrationTableIfNecessary(ctx, spannerAdminClient, emulatorDatabase.connection, schemaMigrationsTable)
+			createMigrationTableIfNecessary(ctx, spannerAdminClient, emulatorDatabase.connection, dataMigrationsTable)
+		}
+
+		applyAllMigrations(ctx, spannerClient, spannerAdminClient, v.Dir, 0, ddl, dml)
+		applyRepeatableMigrations(ctx, spannerClient, spannerAdminClient, v.Dir)
+		ddlCount += len(ddl)
+		dmlCount += len(dml)
+	}
+
+	logInfo(fmt.Sprintf("Verified '%d' DDL and '%d' DML migrations of env %q", ddlCount, dmlCount, envId))
+}
+
+// VERIFY <--------------------------------------------------
+
+// EMULATOR >--------------------------------------------------
+
+const (
+	defaultEmulatorHost      = "localhost:9010"
+	defaultEmulatorProjectId = "emulator-project"
+	defaultEmulatorInstance  = "emulator-instance"
+)
+
+type emulatorDatabase struct {
+	id          string
+	connection  string
+	adminClient *database.DatabaseAdminClient
+}
+
+// resolveEmulatorSettings determines the emulator host, from the flag, SPANNER_EMULATOR_HOST or the default, and in
+// emulator mode defaults the project and instance, which only exist in the emulator
+func resolveEmulatorSettings() {
+	if emulatorHost == "" {
+		emulatorHost = os.Getenv("SPANNER_EMULATOR_HOST")
+	}
+	if emulatorHost == "" {
+		emulatorHost = defaultEmulatorHost
+	}
+
+	if !useEmulator {
+		return
+	}
+	if gcpProjectId == "" {
+		gcpProjectId = defaultEmulatorProjectId
+	}
+	if spannerInstanceId == "" {
+		spannerInstanceId = defaultEmulatorInstance
+	}
+}
+
+// setupEmulator points the spanner clients, and those of 'migrate', at the emulator and creates the instance and,
+// optionally, the database if they do not already exist
+func setupEmulator(ctx context.Context, createDatabase bool) {
+	logInfo(fmt.Sprintf("Using spanner emulator %q", emulatorHost))
+	if err := os.Setenv("SPANNER_EMULATOR_HOST", emulatorHost); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed setting SPANNER_EMULATOR_HOST: %v", err))
+	}
+
+	createEmulatorInstanceIfNecessary(ctx)
+	if !createDatabase || spannerDatabaseId == "" {
+		return
+	}
+
+	adminClient, err := database.NewDatabaseAdminClient(ctx, emulatorClientOptions()...)
+	if err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed creating database admin client for emulator %q: %v", emulatorHost, err))
+	}
+	defer adminClient.Close()
+
+	connection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId)
+	if _, err := adminClient.GetDatabase(ctx, &adminpb.GetDatabaseRequest{Name: connection}); err == nil {
+		return
+	} else if spanner.ErrCode(err) != codes.NotFound {
+		logFatal(spannerErrorCategory(err, errConfiguration), fmt.Sprintf("Failed getting emulator database %q from %q: %v", connection, emulatorHost, err))
+	}
+
+	logInfo(fmt.Sprintf("Creating emulator database %q", connection))
+	op, err := adminClient.CreateDatabase(ctx, &adminpb.CreateDatabaseRequest{
+		Parent:          fmt.Sprintf("projects/%s/instances/%s", gcpProjectId, spannerInstanceId),
+		CreateStatement: createDatabaseStatement(spannerDatabaseId),
+		DatabaseDialect: dialect,
+	})
+	if err == nil {
+		_, err = op.Wait(ctx)
+	}
+	if err != nil && spanner.ErrCode(err) != codes.AlreadyExists {
+		logFatal(spannerErrorCategory(err, errConfiguration), fmt.Sprintf("Failed creating emulator database %q in %q: %v", connection, emulatorHost, err))
+	}
+}
+
+// emulatorClientOptions connect to the emulator without TLS or credentials
+func emulatorClientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(emulatorHost),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}
+}
+
+// createEmulatorInstanceIfNecessary creates the spanner instance in the emulator if it does not already exist
+func createEmulatorInstanceIfNecessary(ctx context.Context) {
+	instanceAdminClient, err := instance.NewInstanceAdminClient(ctx, emulatorClientOptions()...)
+	if err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed creating instance admin client for emulator %q: %v", emulatorHost, err))
+	}
+	defer instanceAdminClient.Close()
+
+	instanceName := fmt.Sprintf("projects/%s/instances/%s", gcpProjectId, spannerInstanceId)
+	if _, err := instanceAdminClient.GetInstance(ctx, &instancepb.GetInstanceRequest{Name: instanceName}); err == nil {
+		return
+	} else if spanner.ErrCode(err) != codes.NotFound {
+		logFatal(spannerErrorCategory(err, errConfiguration), fmt.Sprintf("Failed getting emulator instance %q from %q: %v", instanceName, emulatorHost, err))
+	}
+
+	logInfo(fmt.Sprintf("Creating emulator instance %q", instanceName))
+	op, err := instanceAdminClient.CreateInstance(ctx, &instancepb.CreateInstanceRequest{
+		Parent:     fmt.Sprintf("projects/%s", gcpProjectId),
+		InstanceId: spannerInstanceId,
+		Instance: &instancepb.Instance{
+			Config:      fmt.Sprintf("projects/%s/instanceConfigs/emulator-config", gcpProjectId),
+			DisplayName: spannerInstanceId,
+			NodeCount:   1,
+		},
+	})
+	if err == nil {
+		_, err = op.Wait(ctx)
+	}
+	if err != nil && spanner.ErrCode(err) != codes.AlreadyExists {
+		logFatal(spannerErrorCategory(err, errConfiguration), fmt.Sprintf("Failed creating emulator instance %q in %q: %v", instanceName, emulatorHost, err))
+	}
+}
+
+// createEmulatorDatabase creates a new, uniquely named, database in the emulator instance
+func createEmulatorDatabase(ctx context.Context, prefix string) *emulatorDatabase {
+	createEmulatorInstanceIfNecessary(ctx)
+
+	adminClient, err := database.NewDatabaseAdminClient(ctx, emulatorClientOptions()...)
+	if err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed creating database admin client for emulator %q: %v", emulatorHost, err))
+	}
+
+	databaseId := fmt.Sprintf("%s-%s", prefix, strings.ToLower(strings.Split(pseudoUuid(), "-")[0]))
+	op, err := adminClient.CreateDatabase(ctx, &adminpb.CreateDatabaseRequest{
+		Parent:          fmt.Sprintf("projects/%s/instances/%s", gcpProjectId, spannerInstanceId),
+		CreateStatement: createDatabaseStatement(databaseId),
+		DatabaseDialect: dialect,
+	})
+	if err == nil {
+		_, err = op.Wait(ctx)
+	}
+	if err != nil {
+		adminClient.Close()
+		logFatal(spannerErrorCategory(err, errConfiguration), fmt.Sprintf("Failed creating emulator database %q in %q: %v", databaseId, emulatorHost, err))
+	}
+
+	connection := fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, databaseId)
+	logDebug(fmt.Sprintf("Created emulator database %q", connection))
+	return &emulatorDatabase{id: databaseId, connection: connection, adminClient: adminClient}
+}
+
+// dropEmulatorDatabase drops an emulator database, with its own context so that it is dropped even when interrupted,
+// where failures are only logged
+func dropEmulatorDatabase(d *emulatorDatabase) {
+	defer d.adminClient.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := d.adminClient.DropDatabase(ctx, &adminpb.DropDatabaseRequest{Database: d.connection}); err != nil {
+		logWarn(fmt.Sprintf("Failed dropping emulator database %q: %v", d.connection, err))
+		return
+	}
+	logDebug(fmt.Sprintf("Dropped emulator database %q", d.connection))
+}
+
+// EMULATOR <--------------------------------------------------
+
+// FLEET >--------------------------------------------------
+
+type fleetResult struct {
+	database string
+	started  bool
+	duration time.Duration
+	err      error
+	exitCode int
+}
+
+// fleet applies the same migrations to many spanner databases in the same instance by running migratex `up` for each
+// database in a child process, at most `-parallelism` at a time. The first `-canary` databases are migrated on their
+// own first and the rest are only migrated if they all succeed.
+func fleet(ctx context.Context, workingDir string, config *config) {
+	logDebug(fmt.Sprintf("Checking args"))
+	if err := checkFleetArgs(); err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed checking required command line arguments: %v", err))
+	}
+	logDebug(fmt.Sprintf("Checked args"))
+
+	databases := fleetDatabases(ctx, config)
+	if len(databases) == 0 {
+		logInfo("No databases found to migrate")
+		return
+	}
+	logInfo(fmt.Sprintf("Migrating '%d' databases: %v", len(databases), databases))
+
+	executable, err := os.Executable()
+	if err != nil {
+		logFatal(errUnexpected, fmt.Sprintf("Failed determining the migratex executable: %v", err))
+	}
+
+	var waves [][]string
+	if canary > 0 && canary < len(databases) {
+		waves = append(waves, databases[:canary], databases[canary:])
+	} else {
+		waves = append(waves, databases)
+	}
+
+	var results []*fleetResult
+	failed := false
+	for i, wave := range waves {
+		if failed {
+			for _, v := range wave {
+				results = append(results, &fleetResult{database: v})
+			}
+			continue
+		}
+		logInfo(fmt.Sprintf("Migrating wave '%d' of '%d' with '%d' databases: %v", i+1, len(waves), len(wave), wave))
+		waveResults := migrateFleetWave(ctx, executable, workingDir, wave)
+		for _, v := range waveResults {
+			if v.err != nil || !v.started {
+				failed = true
+			}
+		}
+		results = append(results, waveResults...)
+	}
+
+	logFleetSummary(results)
+
+	if failed {
+		category := errUnexpected
+		if errors.Is(ctx.Err(), context.Canceled) {
+			category = errInterrupted
+		} else if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			category = errTimeout
+		}
+		for _, v := range results {
+			if v.err != nil {
+				category = exitCodeErrorCategory(v.exitCode)
+				break
+			}
+		}
+		logFatal(category, "Failed migrating all databases")
+	}
+}
+
+func checkFleetArgs() error {
+	if envId == "" {
+		return errors.New("Missing command line argument `env_id`")
+
+	} else if gcpProjectId == "" {
+		return errors.New("Missing command line argument `gcp_project_id`")
+
+	} else if spannerInstanceId == "" {
+		return errors.New("Missing command line argument `spanner_instance_id`")
+
+	} else if parallelism < 1 {
+		return errors.New("Command line argument `parallelism` must be at least 1")
+	}
+	return nil
+}
+
+// fleetDatabases determines the databases to migrate from exactly one of the databases file, the database pattern or
+// the databases of the environment in the config file
+func fleetDatabases(ctx context.Context, config *config) []string {
+	var configDatabases []string
+	if config != nil {
+		configDatabases = config.databases(envId)
+	}
+
+	switch {
+	case databasesFile != "" && databasePattern != "":
+		logFatal(errConfiguration, "Only one of the command line arguments `databases_file` and `database_pattern` is allowed")
+		return nil
+
+	case (databasesFile != "" || databasePattern != "") && len(configDatabases) > 0:
+		logFatal(errConfiguration, fmt.Sprintf("The command line arguments `databases_file` and `database_pattern` are not allowed when config file %q lists the `databases` of env %q", config.file, envId))
+		return nil
+
+	case databasesFile != "":
+		fileBytes, err := ioutil.ReadFile(databasesFile)
+		if err != nil {
+			logFatal(errConfiguration, fmt.Sprintf("Failed reading databases file %q: %v", databasesFile, err))
+		}
+		var databases []string
+		for _, v := range strings.Split(string(fileBytes), "\n") {
+			v = strings.TrimSpace(v)
+			if v != "" && !strings.HasPrefix(v, "#") {
+				databases = append(databases, v)
+			}
+		}
+		return databases
+
+	case databasePattern != "":
+		return listDatabases(ctx, databasePattern)
+
+	case len(configDatabases) > 0:
+		return configDatabases
+
+	default:
+		logFatal(errConfiguration, "Missing databases to migrate, use the command line argument `databases_file` or `database_pattern` or list the `databases` of the environment in the config file")
+		return nil
+	}
+}
+
+// listDatabases lists the databases in the spanner instance whose IDs match the pattern
+func listDatabases(ctx context.Context, pattern string) []string {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed compiling database pattern %q: %v", pattern, err))
+	}
+
+	spannerAdminClient, err := database.NewDatabaseAdminClient(ctx)
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errConfiguration), fmt.Sprintf("Failed initializing spanner admin client: %v", err))
+	}
+	defer spannerAdminClient.Close()
+
+	instance := fmt.Sprintf("projects/%s/instances/%s", gcpProjectId, spannerInstanceId)
+	logInfo(fmt.Sprintf("Listing databases in instance %q matching %q", instance, pattern))
+
+	var databases []string
+	iter := spannerAdminClient.ListDatabases(ctx, &adminpb.ListDatabasesRequest{Parent: instance})
+	for {
+		db, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			logFatal(spannerErrorCategory(err, errConfiguration), fmt.Sprintf("Failed listing databases in instance %q: %v", instance, err))
+		}
+		id := db.Name[strings.LastIndex(db.Name, "/")+1:]
+		if re.MatchString(id) {
+			databases = append(databases, id)
+		}
+	}
+	sort.Strings(databases)
+	return databases
+}
+
+func migrateFleetWave(ctx context.Context, executable, workingDir string, databases []string) []*fleetResult {
+	results := make([]*fleetResult, len(databases))
+	for i, v := range databases {
+		results[i] = &fleetResult{database: v}
+	}
+
+	var mu sync.Mutex
+	failed := false
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+	for _, r := range results {
+		sem <- struct{}{}
+
+		mu.Lock()
+		stop := failFast && failed
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			<-sem
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *fleetResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			migrateFleetDatabase(ctx, executable, workingDir, r)
+
+			if r.err != nil {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func migrateFleetDatabase(ctx context.Context, executable, workingDir string, r *fleetResult) {
+	args := []string{
+		commandUp,
+		"-env_id", envId,
+		"-gcp_project_id", gcpProjectId,
+		"-spanner_instance_id", spannerInstanceId,
+		"-spanner_database_id", r.database,
+		"-timeout", strconv.Itoa(timeout),
+		"-log_format", logFormat,
+		"-log_level", logLevel,
+		"-otel_exporter", otelExporter,
+	}
+	if otelEndpoint != "" {
+		args = append(args, "-otel_endpoint", otelEndpoint)
+	}
+	if configFile != "" {
+		args = append(args, "-config", configFile)
+	}
+	if tokenFile != "" {
+		args = append(args, "-token_file", tokenFile)
+	}
+	if stream != "" {
+		args = append(args, "-stream", stream)
+	}
+	if useHistory {
+		args = append(args, "-history")
+	}
+	if outOfOrder {
+		args = append(args, "-out_of_order")
+	}
+	if useEmulator {
+		args = append(args, "-emulator", "-emulator_host", emulatorHost, "-database_dialect", databaseDialect)
+	}
+
+	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.Dir = workingDir
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%sRUN_ID=%s", configEnvVarPrefix, l.runId))
+	var outb bytes.Buffer
+	cmd.Stdout = &outb
+	cmd.Stderr = &outb
+
+	logInfo(fmt.Sprintf("Migrating database %q: %v", r.database, cmd.Args))
+	start := time.Now()
+	r.started = true
+	r.err = cmd.Run()
+	r.duration = time.Since(start)
+	if exitErr, ok := r.err.(*exec.ExitError); ok {
+		r.exitCode = exitErr.ExitCode()
+	} else if r.err != nil {
+		r.exitCode = int(errUnexpected)
+	}
+
+	if r.err != nil {
+		logError(fmt.Sprintf("Failed migrating database %q after %v: %v\n%s", r.database, r.duration, r.err, outb.String()))
+		return
+	}
+	logDebug(fmt.Sprintf("Output migrating database %q:\n%s", r.database, outb.String()))
+	logInfo(fmt.Sprintf("Migrated database %q in %v", r.database, r.duration))
+}
+
+func logFleetSummary(results []*fleetResult) {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DATABASE\tRESULT\tDURATION")
+	for _, v := range results {
+		result := "OK"
+		if !v.started {
+			result = "SKIPPED"
+		} else if v.err != nil {
+			result = fmt.Sprintf("FAILED (%s)", exitCodeErrorCategory(v.exitCode))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\n", v.database, result, v.duration.Round(time.Millisecond))
+	}
+	w.Flush()
+	logInfo(fmt.Sprintf("Fleet summary:\n%s", b.String()))
+}
+
+// FLEET <--------------------------------------------------
+
+// clearDataMigrationsDirty deletes a version inserted as dirty by setDataMigrationsDirty when its migration was rolled
+// back, using a new context since the context of the run has been cancelled
+func clearDataMigrationsDirty(spannerClient *spanner.Client, version int64) {
+	table := trackingTable("dml")
+	logInfo(fmt.Sprintf("Deleting dirty version '%d' from %s table since its migration was rolled back", version, table))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	stmt := dialectStatement(fmt.Sprintf("DELETE FROM %s WHERE Version=@version AND Dirty=@dirty", table), "dirty", true, "version", version)
+	if useHistory {
+		stmt = dialectStatement(fmt.Sprintf("DELETE FROM %s WHERE Revision=@version AND Kind=@kind AND Dirty=@dirty", table), "dirty", true, "version", version, "kind", "dml")
+	}
+	_, err := spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		_, err := txn.Update(ctx, stmt)
+		return err
+	})
+	if err != nil {
+		logError(fmt.Sprintf("Failed deleting dirty version '%d' from %s table, this must be manually fixed before more migrations can be applied: %v", version, table, err))
+	}
+}
+
+// SPANNER >--------------------------------------------------
+func newSpannerClient(ctx context.Context, databseConnection string) (*spanner.Client, *database.DatabaseAdminClient) {
+	logDebug(fmt.Sprintf("Initializing spanner data and admin clients"))
+
+	ctx, span := startSpan(ctx, "createSpannerClients")
+	defer endSpan(span)
+
+	circleciProjectRepoName := os.Getenv("CIRCLE_PROJECT_REPONAME")
+	circleci := circleciProjectRepoName != ""
+
+	var runtimeLabel string
+	if circleci {
+		runtimeLabel = fmt.Sprintf("%s-%s", circleciProjectRepoName, os.Getenv("CIRCLE_SHA1")[:7])
+	} else {
+		runtimeLabel = os.Getenv("USER")
+	}
+
+	minOpenedSessions := 2
+	writeSessions := .5
+	sessionId := strings.ToLower(pseudoUuid())
+	sessionLocation := runtimeLabel
+
+	// If the protocol is not met (https://cloud.google.com/spanner/docs/reference/rpc/google.spanner.v1#session) the following error is generated
+	// -> spanner: code = "InvalidArgument", desc = "Invalid CreateSession request."
+	spannerClientConfig := spanner.ClientConfig{
+		SessionPoolConfig: spanner.SessionPoolConfig{
+			MinOpened:     uint64(minOpenedSessions),
+			WriteSessions: writeSessions,
+		},
+		SessionLabels: map[string]string{
+			"id":       sessionId,
+			"location": sessionLocation,
+		},
+	}
+
+	logDebug(fmt.Sprintf("Creating spanner client using connection string %q, minOpenedSessions '%d', sessionId %q, sessionLocation %q", databseConnection, minOpenedSessions, sessionId, sessionLocation))
+	spannerClient, err := spanner.NewClientWithConfig(ctx, databseConnection, spannerClientConfig)
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errConfiguration), fmt.Sprintf("Failed initializing spanner data client for connection %q: %v", databseConnection, err))
+	}
+
+	spannerAdminClient, err := database.NewDatabaseAdminClient(ctx)
+	if err != nil {
+		logFatal(spannerErrorCategory(err, errConfiguration), fmt.Sprintf("Failed initializing spanner admin client: %v", err))
+	}
+
+	logDebug(fmt.Sprintf("Initialized spanner data and admin clients"))
+
+	return spannerClient, spannerAdminClient
+}
+
+// SPANNER <--------------------------------------------------
+
+// CLEANUP >--------------------------------------------------
+
+// cancelOnInterrupt cancels the context on the first SIGINT or SIGTERM so that in-flight work can finish or roll back,
+// exiting immediately on the second
+func cancelOnInterrupt(cancel context.CancelFunc) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		logWarn(fmt.Sprintf("Received %v, stopping once in-flight work has finished or rolled back, send it again to exit immediately", sig))
+		cancel()
+
+		sig = <-c
+		logError(fmt.Sprintf("Received %v again, exiting immediately without waiting for in-flight work", sig))
+		os.Exit(int(errInterrupted))
+	}()
+}
+
+// CLEANUP <--------------------------------------------------
+
+// MISC >--------------------------------------------------
+func pseudoUuid() (uuid string) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		logFatal(errUnexpected, fmt.Sprintf("Failed gnerating UUID: %v", err))
+		return
+	}
+	uuid = fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	return
+}
+
+func replaceWhiteSpaceWithSpace(str string) string {
+	s := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return r
+	}, str)
+	return strings.TrimSpace(strings.Join(strings.Fields(s), " "))
+}
+
+// MISC <--------------------------------------------------
+
+// HOOKS >--------------------------------------------------
+
+const (
+	hookBeforeRun       = "before_run"
+	hookBeforeMigration = "before_migration"
+	hookAfterMigration  = "after_migration"
+	hookAfterRun        = "after_run"
+	hookOnFailure       = "on_failure"
+)
+
+// runHooks are the hooks of the current run
+var runHooks *hooks
+
+type hooks struct {
+	hooks map[string][]hookConfig
+
+	// Created when first needed by a SQL hook
+	spannerClient      *spanner.Client
+	spannerAdminClient *database.DatabaseAdminClient
+}
+
+// hookEnv is the metadata passed to hooks as MIGRATEX_HOOK_* environment variables
+type hookEnv struct {
+	migration string
+	err       interface{}
+}
+
+func newHooks(config *config) *hooks {
+	h := &hooks{hooks: make(map[string][]hookConfig)}
+	if config != nil {
+		h.hooks = config.hooks(envId)
+	}
+	return h
+}
+
+func (h *hooks) has(point string) bool {
+	return len(h.hooks[point]) > 0
+}
+
+// run runs the hooks of a hook point in order, failing the run if any hook fails
+func (h *hooks) run(ctx context.Context, point string, env hookEnv) {
+	for i, v := range h.hooks[point] {
+		if err := h.runHook(ctx, point, v, env); err != nil {
+			logFatal(errHook, fmt.Sprintf("Failed running hook '%d' of %q: %v", i+1, point, err))
+		}
+	}
+}
+
+// runOnFailure runs the on_failure hooks after the run failed, where failures of the hooks themselves are only logged
+// so the original failure is reported
+func (h *hooks) runOnFailure(failure interface{}) {
+	// The context of the run may have been cancelled or timed out but the hooks should still run
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	for i, v := range h.hooks[hookOnFailure] {
+		if err := h.runHook(ctx, hookOnFailure, v, hookEnv{err: failure}); err != nil {
+			logError(fmt.Sprintf("Failed running hook '%d' of %q: %v", i+1, hookOnFailure, err))
+		}
+	}
+}
+
+func (h *hooks) runHook(ctx context.Context, point string, hook hookConfig, env hookEnv) error {
+	ctx, span := startSpan(ctx, "hook", attribute.String("migratex.hook", point))
+	defer endSpan(span)
+
+	if hook.Command != "" {
+		return h.runCommand(ctx, point, hook.Command, env)
+	}
+	return h.runSql(ctx, point, hook.Sql)
+}
+
+func (h *hooks) runCommand(ctx context.Context, point, command string, env hookEnv) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.Env = append(os.Environ(),
+		"MIGRATEX_HOOK_POINT="+point,
+		"MIGRATEX_HOOK_RUN_ID="+l.runId,
+		"MIGRATEX_HOOK_ENV_ID="+envId,
+		"MIGRATEX_HOOK_GCP_PROJECT_ID="+gcpProjectId,
+		"MIGRATEX_HOOK_SPANNER_INSTANCE_ID="+spannerInstanceId,
+		"MIGRATEX_HOOK_SPANNER_DATABASE_ID="+spannerDatabaseId,
+	)
+	if env.migration != "" {
+		cmd.Env = append(cmd.Env,
+			"MIGRATEX_HOOK_MIGRATION="+env.migration,
+			"MIGRATEX_HOOK_KIND="+migrationKind(env.migration),
+		)
+		if migrationStream != "" {
+			cmd.Env = append(cmd.Env, "MIGRATEX_HOOK_STREAM="+migrationStream)
+		}
+		if version, err := migrationVersion(env.migration); err == nil {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("MIGRATEX_HOOK_REVISION=%d", version))
+		}
+	}
+	if env.err != nil {
+		cmd.Env = append(cmd.Env, "MIGRATEX_HOOK_ERROR="+redact(fmt.Sprint(env.err)))
+	}
+	var outb bytes.Buffer
+	cmd.Stdout = &outb
+	cmd.Stderr = &outb
+
+	logInfo(fmt.Sprintf("Running %q hook command %q", point, command))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("command %q failed with output %q: %v", command, outb.String(), err)
+	}
+	logInfo(fmt.Sprintf("Ran %q hook command %q with output %q", point, command, outb.String()))
+	return nil
+}
+
+// readHookSql splits a SQL file into its DML statements the same way as DML migrations, along with the expectations of
+// their row counts
+func readHookSql(file string) ([]spanner.Statement, []*expectation, error) {
+	fileBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed reading SQL file %q: %v", file, err)
+	}
+	split, err := splitStatements(string(fileBytes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed splitting SQL file %q into statements: %v", file, err)
+	}
+
+	var statements []spanner.Statement
+	var expectations []*expectation
+	for _, v := range split {
+		statements = append(statements, spanner.Statement{SQL: v.sql + ";"})
+		expectations = append(expectations, v.expect)
+	}
+	return statements, expectations, nil
+}
+
+// runSql runs the DML statements of a SQL file in a single transaction
+func (h *hooks) runSql(ctx context.Context, point, file string) error {
+	statements, expectations, err := readHookSql(file)
+	if err != nil {
+		return err
+	}
+	if len(statements) == 0 {
+		return nil
+	}
+
+	if h.spannerClient == nil {
+		h.spannerClient, h.spannerAdminClient = newSpannerClient(ctx, fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId))
+	}
+
+	logInfo(fmt.Sprintf("Running %q hook SQL file %q: %s", point, file, fmtStatements(statements)))
+	_, err = h.spannerClient.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		rowCounts, err := txn.BatchUpdate(ctx, statements)
+		if err != nil {
+			return err
+		}
+		if err := checkRowCounts(file, statements, expectations, rowCounts); err != nil {
+			return err
+		}
+		logInfo(fmt.Sprintf("Ran %q hook SQL file %q. Updated row counts '%d'", point, file, rowCounts))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("SQL file %q failed: %v", file, err)
+	}
+	return nil
+}
+
+func (h *hooks) close() {
+	if h.spannerClient != nil {
+		h.spannerClient.Close()
+		h.spannerAdminClient.Close()
+		h.spannerClient, h.spannerAdminClient = nil, nil
+	}
+}
+
+// catchFatal runs f, returning the value recovered if it panics through logFatal
+func catchFatal(f func()) (r interface{}) {
+	defer func() {
+		r = recover()
+	}()
+	f()
+	return nil
+}
+
+// HOOKS <--------------------------------------------------
+
+// TELEMETRY >--------------------------------------------------
+
+const (
+	otelExporterNone   = "none"
+	otelExporterStdout = "stdout"
+	otelExporterOtlp   = "otlp"
+)
+
+var (
+	tracer = otel.Tracer("migratex")
+	meter  = otel.Meter("migratex")
+
+	migrationsCounter   metric.Int64Counter
+	migrationDuration   metric.Float64Histogram
+	rowsAffectedCounter metric.Int64Counter
+)
+
+// setupTelemetry installs the OpenTelemetry trace and meter providers for the `otel_exporter` command line argument,
+// returning a function that flushes and shuts them down
+func setupTelemetry(ctx context.Context) func() {
+	var spanExporter sdktrace.SpanExporter
+	var metricExporter sdkmetric.Exporter
+	var err error
+
+	switch otelExporter {
+	case otelExporterNone, "":
+		createInstruments()
+		return func() {}
+
+	case otelExporterStdout:
+		if spanExporter, err = stdouttrace.New(); err == nil {
+			metricExporter, err = stdoutmetric.New()
+		}
+
+	case otelExporterOtlp:
+		var traceOptions []otlptracegrpc.Option
+		var metricOptions []otlpmetricgrpc.Option
+		if otelEndpoint != "" {
+			traceOptions = append(traceOptions, otlptracegrpc.WithEndpointURL(otelEndpoint))
+			metricOptions = append(metricOptions, otlpmetricgrpc.WithEndpointURL(otelEndpoint))
+		}
+		if spanExporter, err = otlptracegrpc.New(ctx, traceOptions...); err == nil {
+			metricExporter, err = otlpmetricgrpc.New(ctx, metricOptions...)
+		}
+
+	default:
+		logFatal(errConfiguration, fmt.Sprintf("Unknown OpenTelemetry exporter %q, expected %q, %q or %q", otelExporter, otelExporterNone, otelExporterStdout, otelExporterOtlp))
+	}
+	if err != nil {
+		logFatal(errConfiguration, fmt.Sprintf("Failed creating OpenTelemetry %q exporter: %v", otelExporter, err))
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", "migratex"),
+		attribute.String("migratex.run_id", l.runId),
+		attribute.String("migratex.env", envId),
+		attribute.String("migratex.database", spannerDatabaseId),
+	)
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)), sdkmetric.WithResource(res))
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetMeterProvider(meterProvider)
+	createInstruments()
+
+	logDebug(fmt.Sprintf("Exporting OpenTelemetry traces and metrics to %q", otelExporter))
+
+	return func() {
+		// The context of the run may have been cancelled or timed out but the telemetry should still be flushed
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			logWarn(fmt.Sprintf("Failed flushing OpenTelemetry traces: %v", err))
+		}
+		if err := meterProvider.Shutdown(ctx); err != nil {
+			logWarn(fmt.Sprintf("Failed flushing OpenTelemetry metrics: %v", err))
+		}
+	}
+}
+
+func createInstruments() {
+	var err error
+	if migrationsCounter, err = meter.Int64Counter("migratex.migrations", metric.WithDescription("The number of migrations applied"), metric.WithUnit("{migration}")); err != nil {
+		logFatal(errUnexpected, fmt.Sprintf("Failed creating OpenTelemetry instrument: %v", err))
+	}
+	if migrationDuration, err = meter.Float64Histogram("migratex.migration.duration", metric.WithDescription("The duration of applying a migration"), metric.WithUnit("s")); err != nil {
+		logFatal(errUnexpected, fmt.Sprintf("Failed creating OpenTelemetry instrument: %v", err))
+	}
+	if rowsAffectedCounter, err = meter.Int64Counter("migratex.dml.rows_affected", metric.WithDescription("The number of rows affected by DML migrations"), metric.WithUnit("{row}")); err != nil {
+		logFatal(errUnexpected, fmt.Sprintf("Failed creating OpenTelemetry instrument: %v", err))
+	}
+}
+
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endSpan ends a span, recording the error if logFatal is panicking, for use with defer
+func endSpan(span trace.Span) {
+	if r := recover(); r != nil {
+		span.SetStatus(otelcodes.Error, redact(fmt.Sprint(r)))
+		span.End()
+		panic(r)
+	}
+	span.End()
+}
+
+func migrationKind(migration string) string {
+	if strings.HasSuffix(migration, ".ddl.up.sql") {
+		return "ddl"
+	}
+	if isRepeatableMigration(migration) {
+		return "repeatable"
+	}
+	return "dml"
+}
+
+func startMigrationSpan(ctx context.Context, migration string) (context.Context, trace.Span) {
+	attributes := []attribute.KeyValue{
+		attribute.String("migratex.migration", migration),
+		attribute.String("migratex.kind", migrationKind(migration)),
+	}
+	if version, err := migrationVersion(migration); err == nil {
+		attributes = append(attributes, attribute.Int64("migratex.revision", version))
+	}
+	return startSpan(ctx, "migration", attributes...)
+}
+
+// endMigrationSpan ends the span of a migration and records its metrics, for use with defer
+func endMigrationSpan(span trace.Span, migration string, start time.Time) {
+	r := recover()
+
+	outcome := outcomeSucceeded
+	if r != nil {
+		outcome = outcomeFailed
+		span.SetStatus(otelcodes.Error, redact(fmt.Sprint(r)))
+	}
+	span.End()
+
+	// A background context since the metrics should be recorded even if the context of the run was cancelled
+	attributes := metric.WithAttributes(attribute.String("migratex.kind", migrationKind(migration)), attribute.String("migratex.outcome", outcome))
+	migrationsCounter.Add(context.Background(), 1, attributes)
+	migrationDuration.Record(context.Background(), time.Since(start).Seconds(), attributes)
+
+	if r != nil {
+		panic(r)
+	}
+}
+
+// recordRowsAffected adds the total rows affected by the statements of a DML migration to its span and metrics
+func recordRowsAffected(ctx context.Context, rowCounts []int64) {
+	var rows int64
+	for _, v := range rowCounts {
+		rows += v
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("migratex.rows_affected", rows))
+	rowsAffectedCounter.Add(ctx, rows)
+}
 
-	circleciProjectRepoName := os.Getenv("CIRCLE_PROJECT_REPONAME")
-	circleci := circleciProjectRepoName != ""
+// TELEMETRY <--------------------------------------------------
 
-	var runtimeLabel string
-	if circleci {
-		runtimeLabel = fmt.Sprintf("%s-%s", circleciProjectRepoName, os.Getenv("CIRCLE_SHA1")[:7])
-	} else {
-		runtimeLabel = os.Getenv("USER")
+// ERRORS >--------------------------------------------------
+
+// errorCategory categorizes fatal errors, where the value of each category is the exit code of the process
+type errorCategory int
+
+const (
+	errUnexpected        errorCategory = 1
+	errConfiguration     errorCategory = 2
+	errDiscovery         errorCategory = 3
+	errInconsistentState errorCategory = 4
+	errDirtyState        errorCategory = 5
+	errDdl               errorCategory = 6
+	errDml               errorCategory = 7
+	errLockContention    errorCategory = 8
+	errTimeout           errorCategory = 9
+	errInterrupted       errorCategory = 10
+	errHook              errorCategory = 11
+	errSchemaDrift       errorCategory = 12
+	errAssertion         errorCategory = 13
+)
+
+var errorCategoryNames = map[errorCategory]string{
+	errUnexpected:        "Unexpected error",
+	errConfiguration:     "Configuration error",
+	errDiscovery:         "Discovery error",
+	errInconsistentState: "Inconsistent state",
+	errDirtyState:        "Dirty state",
+	errDdl:               "DDL failure",
+	errDml:               "DML failure",
+	errLockContention:    "Lock contention",
+	errTimeout:           "Timeout",
+	errInterrupted:       "Interrupted",
+	errHook:              "Hook failure",
+	errSchemaDrift:       "Schema drift",
+	errAssertion:         "Assertion failure",
+}
+
+func (c errorCategory) String() string {
+	if name, ok := errorCategoryNames[c]; ok {
+		return name
 	}
+	return fmt.Sprintf("Error %d", int(c))
+}
 
-	minOpenedSessions := 2
-	writeSessions := .5
-	sessionId := strings.ToLower(pseudoUuid())
-	sessionLocation := runtimeLabel
+func exitCodeErrorCategory(exitCode int) errorCategory {
+	if _, ok := errorCategoryNames[errorCategory(exitCode)]; ok {
+		return errorCategory(exitCode)
+	}
+	return errUnexpected
+}
 
-	// If the protocol is not met (https://cloud.google.com/spanner/docs/reference/rpc/google.spanner.v1#session) the following error is generated
-	// -> spanner: code = "InvalidArgument", desc = "Invalid CreateSession request."
-	spannerClientConfig := spanner.ClientConfig{
-		SessionPoolConfig: spanner.SessionPoolConfig{
-			MinOpened:     uint64(minOpenedSessions),
-			WriteSessions: writeSessions,
-		},
-		SessionLabels: map[string]string{
-			"id":       sessionId,
-			"location": sessionLocation,
-		},
+type migratexError struct {
+	category errorCategory
+	message  string
+}
+
+func (e *migratexError) Error() string {
+	return fmt.Sprintf("%s: %s", e.category, e.message)
+}
+
+// spannerErrorCategory categorizes errors returned by spanner where they are not specific to what was being done,
+// such as timeouts and missing credentials, otherwise returning the fallback. Transactions aborted by conflicting
+// transactions are retried by the client until they succeed or time out, see contentionErrorCategory.
+func spannerErrorCategory(err error, fallback errorCategory) errorCategory {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errTimeout
 	}
+	if errors.Is(err, context.Canceled) {
+		return errInterrupted
+	}
+	switch spanner.ErrCode(err) {
+	case codes.DeadlineExceeded:
+		return errTimeout
+	case codes.Canceled:
+		return errInterrupted
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return errConfiguration
+	}
+	return fallback
+}
 
-	logDebug(fmt.Sprintf("Creating spanner client using connection string %q, minOpenedSessions '%d', sessionId %q, sessionLocation %q", databseConnection, minOpenedSessions, sessionId, sessionLocation))
-	spannerClient, err := spanner.NewClientWithConfig(ctx, databseConnection, spannerClientConfig)
-	if err != nil {
-		logFatal(fmt.Sprintf("Failed initializing spanner data client for connection %q: %v", databseConnection, err))
+// contentionErrorCategory categorizes errors of a transaction that a concurrent run may conflict with. Claiming a
+// migration that a concurrent run has already marked as dirty fails as already existing, and a transaction that was
+// aborted and retried until it timed out was held up by conflicting transactions rather than by its own statements.
+func contentionErrorCategory(err error, retried bool, fallback errorCategory) errorCategory {
+	if spanner.ErrCode(err) == codes.AlreadyExists {
+		return errLockContention
 	}
+	category := spannerErrorCategory(err, fallback)
+	if category == errTimeout && retried {
+		return errLockContention
+	}
+	return category
+}
 
-	spannerAdminClient, err := database.NewDatabaseAdminClient(ctx)
-	if err != nil {
-		logFatal(fmt.Sprintf("Failed initializing spanner admin client: %v", err))
+// exitOnFatal exits with the exit code of the category of a fatal error, which has already been logged, rather than
+// letting the panic print a stack trace. Any other panic is left to crash as normal.
+func exitOnFatal() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if e, ok := r.(*migratexError); ok {
+		os.Exit(int(e.category))
 	}
+	panic(r)
+}
 
-	logDebug(fmt.Sprintf("Initialized spanner data and admin clients"))
+// ERRORS <--------------------------------------------------
 
-	return spannerClient, spannerAdminClient
+// REPORT >--------------------------------------------------
+
+const (
+	outcomeSucceeded = "succeeded"
+	outcomeFailed    = "failed"
+	outcomeSkipped   = "skipped"
+)
+
+// report records the current run for the `-report_json` and `-report_junit` command line arguments
+var report *runReport
+
+type runReport struct {
+	RunId              string             `json:"runId"`
+	Env                string             `json:"env"`
+	Database           string             `json:"database"`
+	StartedAt          time.Time          `json:"startedAt"`
+	FinishedAt         time.Time          `json:"finishedAt"`
+	DurationSeconds    float64            `json:"durationSeconds"`
+	StartingDdlVersion int64              `json:"startingSchemaMigrationsVersion"`
+	StartingDmlVersion int64              `json:"startingDataMigrationsVersion"`
+	EndingDdlVersion   int64              `json:"endingSchemaMigrationsVersion"`
+	EndingDmlVersion   int64              `json:"endingDataMigrationsVersion"`
+	Outcome            string             `json:"outcome"`
+	Error              string             `json:"error,omitempty"`
+	ErrorCategory      string             `json:"errorCategory,omitempty"`
+	ExitCode           int                `json:"exitCode"`
+	Streams            []*streamReport    `json:"streams"`
+	Migrations         []*migrationReport `json:"migrations"`
+
+	current *migrationReport
+	// batch are the migrations applied at once with 'migrate up'
+	batch []*migrationReport
+	start time.Time
 }
 
-// SPANNER <--------------------------------------------------
+// streamReport records the versions of a stream, where those of the run are those of its only stream
+type streamReport struct {
+	Name               string `json:"name,omitempty"`
+	StartingDdlVersion int64  `json:"startingSchemaMigrationsVersion"`
+	StartingDmlVersion int64  `json:"startingDataMigrationsVersion"`
+	EndingDdlVersion   int64  `json:"endingSchemaMigrationsVersion"`
+	EndingDmlVersion   int64  `json:"endingDataMigrationsVersion"`
+}
 
-// CLEANUP >--------------------------------------------------
-type Closable interface {
-	Close()
+type migrationReport struct {
+	Name            string  `json:"name"`
+	Stream          string  `json:"stream,omitempty"`
+	Kind            string  `json:"kind"`
+	Revision        int64   `json:"revision,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	RowCounts       []int64 `json:"rowCounts,omitempty"`
+	OutOfOrder      bool    `json:"outOfOrder,omitempty"`
+	Outcome         string  `json:"outcome"`
+	Error           string  `json:"error,omitempty"`
+
+	start time.Time
 }
 
-func cleanUpAndExitOnInterrupt(closables []Closable) {
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
+func newRunReport() *runReport {
+	return &runReport{
+		RunId:     l.runId,
+		Env:       envId,
+		Database:  fmt.Sprintf("projects/%s/instances/%s/databases/%s", gcpProjectId, spannerInstanceId, spannerDatabaseId),
+		StartedAt: time.Now(),
+	}
+}
+
+func (r *runReport) versions(ddl, dml int64) {
+	s := r.stream(migrationStream)
+	s.StartingDdlVersion, s.EndingDdlVersion = ddl, ddl
+	s.StartingDmlVersion, s.EndingDmlVersion = dml, dml
+	r.streamVersions()
+}
 
-		logInfo(fmt.Sprintf("Running clean up"))
-		for _, v := range closables {
-			v.Close()
+func (r *runReport) stream(name string) *streamReport {
+	for _, v := range r.Streams {
+		if v.Name == name {
+			return v
 		}
-		logInfo(fmt.Sprintf("Cleaned"))
+	}
+	s := &streamReport{Name: name}
+	r.Streams = append(r.Streams, s)
+	return s
+}
 
-		os.Exit(0)
-	}()
+// applied records the ending version of the stream of a migration that was applied
+func (r *runReport) applied(m *migrationReport) {
+	s := r.stream(m.Stream)
+	if m.Kind == "ddl" && m.Revision > s.EndingDdlVersion {
+		s.EndingDdlVersion = m.Revision
+	} else if m.Kind == "dml" && m.Revision > s.EndingDmlVersion {
+		s.EndingDmlVersion = m.Revision
+	}
+	r.streamVersions()
 }
 
-// CLEANUP <--------------------------------------------------
+// streamVersions sets the versions of the run to those of its only stream, since the versions of several streams
+// cannot be combined
+func (r *runReport) streamVersions() {
+	var s streamReport
+	if len(r.Streams) == 1 {
+		s = *r.Streams[0]
+	}
+	r.StartingDdlVersion, r.StartingDmlVersion = s.StartingDdlVersion, s.StartingDmlVersion
+	r.EndingDdlVersion, r.EndingDmlVersion = s.EndingDdlVersion, s.EndingDmlVersion
+}
 
-// MISC >--------------------------------------------------
-func pseudoUuid() (uuid string) {
-	b := make([]byte, 16)
-	_, err := rand.Read(b)
-	if err != nil {
-		logFatal(fmt.Sprintf("Failed gnerating UUID: %v", err))
+// pending records the migrations that will be applied, so those never reached are reported as skipped
+func (r *runReport) pending(migrations []string) {
+	for _, v := range migrations {
+		r.migration(v)
+	}
+}
+
+func (r *runReport) migration(name string) *migrationReport {
+	for _, v := range r.Migrations {
+		if v.Name == name && v.Stream == migrationStream {
+			return v
+		}
+	}
+	m := &migrationReport{Name: name, Stream: migrationStream, Kind: migrationKind(name), Outcome: outcomeSkipped}
+	if version, err := migrationVersion(name); err == nil {
+		m.Revision = version
+	}
+	r.Migrations = append(r.Migrations, m)
+	return m
+}
+
+// outOfOrder marks migrations applied before the last applied migration
+func (r *runReport) outOfOrder(migrations []string) {
+	for _, v := range migrations {
+		r.migration(v).OutOfOrder = true
+	}
+}
+
+func (r *runReport) started(name string) {
+	r.current = r.migration(name)
+	r.current.start = time.Now()
+}
+
+// startedAll records the start of migrations applied at once
+func (r *runReport) startedAll(names []string) {
+	r.batch = nil
+	for _, v := range names {
+		m := r.migration(v)
+		m.start = time.Now()
+		r.batch = append(r.batch, m)
+	}
+}
+
+// reachedAll records the outcome of migrations applied at once that failed, given the version and dirty flag of
+// SchemaMigrations afterwards: migrations up to it were applied, except a dirty version which is the one that failed,
+// otherwise the failure of the run is recorded against the first migration not applied
+func (r *runReport) reachedAll(version int64, dirty bool) {
+	batch := r.batch
+	r.batch = nil
+	for _, m := range batch {
+		if m.Revision < version || m.Revision == version && !dirty {
+			m.DurationSeconds = time.Since(m.start).Seconds()
+			m.Outcome = outcomeSucceeded
+			r.applied(m)
+		} else if r.current == nil {
+			r.current = m
+		}
+	}
+}
+
+func (r *runReport) rowCounts(rowCounts []int64) {
+	if r.current != nil {
+		r.current.RowCounts = rowCounts
+	}
+}
+
+func (r *runReport) succeeded() {
+	if r.batch != nil {
+		batch := r.batch
+		r.batch = nil
+		for _, v := range batch {
+			r.current = v
+			r.succeeded()
+		}
 		return
 	}
-	uuid = fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
-	return
+
+	m := r.current
+	if m == nil {
+		return
+	}
+	m.DurationSeconds = time.Since(m.start).Seconds()
+	m.Outcome = outcomeSucceeded
+	r.current = nil
+	r.applied(m)
 }
 
-func replaceWhiteSpaceWithSpace(str string) string {
-	s := strings.Map(func(r rune) rune {
-		if unicode.IsSpace(r) {
-			return ' '
+// finish records the outcome of the run, where failure is the value recovered from the panic of logFatal, if any
+func (r *runReport) finish(failure interface{}) {
+	r.FinishedAt = time.Now()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	r.Outcome = outcomeSucceeded
+	if failure == nil {
+		return
+	}
+
+	r.Outcome = outcomeFailed
+	r.Error = redact(fmt.Sprint(failure))
+	r.ExitCode = int(errUnexpected)
+	if e, ok := failure.(*migratexError); ok {
+		r.ErrorCategory = e.category.String()
+		r.ExitCode = int(e.category)
+	}
+	if r.current == nil && len(r.batch) > 0 {
+		// Which of the migrations applied at once failed is unknown, so the failure is recorded against the first
+		r.current = r.batch[0]
+	}
+	r.batch = nil
+	if m := r.current; m != nil {
+		m.DurationSeconds = time.Since(m.start).Seconds()
+		m.Outcome = outcomeFailed
+		m.Error = r.Error
+		r.current = nil
+	}
+}
+
+func writeReports() {
+	if reportJson != "" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(reportJson, append(b, '\n'), 0644)
 		}
-		return r
-	}, str)
-	return strings.TrimSpace(strings.Join(strings.Fields(s), " "))
+		if err != nil {
+			logError(fmt.Sprintf("Failed writing JSON report %q: %v", reportJson, err))
+		} else {
+			logInfo(fmt.Sprintf("Wrote JSON report %q", reportJson))
+		}
+	}
+
+	if reportJunit != "" {
+		b, err := xml.MarshalIndent(report.junit(), "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(reportJunit, append([]byte(xml.Header), append(b, '\n')...), 0644)
+		}
+		if err != nil {
+			logError(fmt.Sprintf("Failed writing JUnit report %q: %v", reportJunit, err))
+		} else {
+			logInfo(fmt.Sprintf("Wrote JUnit report %q", reportJunit))
+		}
+	}
 }
 
-// MISC <--------------------------------------------------
+type junitTestSuite struct {
+	XMLName    xml.Name        `xml:"testsuite"`
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	TestCases  []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junit converts the report into a JUnit test suite with a test case for each migration, plus one for the run itself
+// if it failed outside of a migration
+func (r *runReport) junit() *junitTestSuite {
+	suite := &junitTestSuite{
+		Name:      fmt.Sprintf("migratex.%s", spannerDatabaseId),
+		Time:      fmtJunitTime(r.DurationSeconds),
+		Timestamp: r.StartedAt.Format("2006-01-02T15:04:05"),
+		Properties: []junitProperty{
+			{Name: "runId", Value: r.RunId},
+			{Name: "env", Value: r.Env},
+			{Name: "database", Value: r.Database},
+			{Name: "startingSchemaMigrationsVersion", Value: strconv.FormatInt(r.StartingDdlVersion, 10)},
+			{Name: "startingDataMigrationsVersion", Value: strconv.FormatInt(r.StartingDmlVersion, 10)},
+			{Name: "endingSchemaMigrationsVersion", Value: strconv.FormatInt(r.EndingDdlVersion, 10)},
+			{Name: "endingDataMigrationsVersion", Value: strconv.FormatInt(r.EndingDmlVersion, 10)},
+		},
+	}
+	if len(r.Streams) > 1 {
+		for _, v := range r.Streams {
+			prefix := ""
+			if v.Name != "" {
+				prefix = v.Name + "."
+			}
+			suite.Properties = append(suite.Properties,
+				junitProperty{Name: prefix + "startingSchemaMigrationsVersion", Value: strconv.FormatInt(v.StartingDdlVersion, 10)},
+				junitProperty{Name: prefix + "startingDataMigrationsVersion", Value: strconv.FormatInt(v.StartingDmlVersion, 10)},
+				junitProperty{Name: prefix + "endingSchemaMigrationsVersion", Value: strconv.FormatInt(v.EndingDdlVersion, 10)},
+				junitProperty{Name: prefix + "endingDataMigrationsVersion", Value: strconv.FormatInt(v.EndingDmlVersion, 10)},
+			)
+		}
+	}
+
+	failedMigration := false
+	for _, v := range r.Migrations {
+		className := fmt.Sprintf("migratex.%s.%s", spannerDatabaseId, v.Kind)
+		if v.Stream != "" {
+			className = fmt.Sprintf("migratex.%s.%s.%s", spannerDatabaseId, v.Stream, v.Kind)
+		}
+		tc := junitTestCase{Name: v.Name, ClassName: className, Time: fmtJunitTime(v.DurationSeconds)}
+		switch v.Outcome {
+		case outcomeFailed:
+			tc.Failure = &junitFailure{Message: v.Error, Text: v.Error}
+			suite.Failures++
+			failedMigration = true
+		case outcomeSkipped:
+			tc.Skipped = &struct{}{}
+			suite.Skipped++
+		}
+		if len(v.RowCounts) > 0 {
+			tc.SystemOut = fmt.Sprintf("rowCounts=%v", v.RowCounts)
+		}
+		if v.OutOfOrder {
+			tc.SystemOut = strings.TrimSpace(tc.SystemOut + " outOfOrder=true")
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	if r.Outcome == outcomeFailed && !failedMigration {
+		suite.TestCases = append(suite.TestCases, junitTestCase{
+			Name:      "migratex",
+			ClassName: fmt.Sprintf("migratex.%s", spannerDatabaseId),
+			Time:      fmtJunitTime(r.DurationSeconds),
+			Failure:   &junitFailure{Message: r.Error, Text: r.Error},
+		})
+		suite.Failures++
+	}
+
+	suite.Tests = len(suite.TestCases)
+	return suite
+}
+
+func fmtJunitTime(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
+
+// REPORT <--------------------------------------------------
+
+// REDACTION >--------------------------------------------------
+
+// redactedValue replaces secret values in logs
+const redactedValue = "*****"
+
+// defaultLogEnvAllowlist are the environment variables whose values are logged, where a trailing '*' matches any
+// suffix. The values of all other environment variables are redacted.
+var defaultLogEnvAllowlist = []string{
+	"CIRCLE_*",
+	"GOOGLE_CLOUD_PROJECT",
+	"HOME",
+	"HOSTNAME",
+	"LANG",
+	"MIGRATEX_*",
+	"PATH",
+	"PWD",
+	"SHELL",
+	"SPANNER_EMULATOR_HOST",
+	"TZ",
+	"USER",
+}
+
+// secretTokenPattern matches the names of tokens that are secret by convention, e.g. `DB_PASSWORD` or `secret_api_key`
+var secretTokenPattern = regexp.MustCompile(`(?i)(secret|password|passwd|token|api_?key|private_?key|credential)`)
+
+var (
+	// secretTokens are the tokens declared secret in the config file
+	secretTokens = make(map[string]bool)
+
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+func isSecretToken(key string) bool {
+	return secretTokens[key] || secretTokenPattern.MatchString(key)
+}
+
+// minSecretLength is the length below which the value of a secret token is not masked, since masking a value such as
+// `1` or `dev` wherever it occurs would make logs unreadable
+const minSecretLength = 4
+
+// addSecret masks every occurrence of the value of a secret token in logs from now on, unless it is too short
+func addSecret(name, value string) {
+	if value == "" {
+		return
+	}
+	if len(value) < minSecretLength {
+		logWarn(fmt.Sprintf("Value of secret token %q is shorter than '%d' characters so is not masked in logs", name, minSecretLength))
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	// Messages quote values with %q, which escapes quotes, backslashes and control characters in the secret
+	quoted := strconv.Quote(value)
+	for _, value := range []string{value, quoted[1 : len(quoted)-1]} {
+		known := false
+		for _, v := range secrets {
+			known = known || v == value
+		}
+		if !known {
+			secrets = append(secrets, value)
+		}
+	}
+	// Longest first so a secret containing another secret is masked in full
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+func redact(message string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, v := range secrets {
+		message = strings.ReplaceAll(message, v, redactedValue)
+	}
+	return message
+}
+
+// redactedEnviron returns the environment with the values of variables that are not allowed to be logged redacted
+func redactedEnviron() []string {
+	allowlist := defaultLogEnvAllowlist
+	for _, v := range strings.Split(logEnvAllowlist, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			allowlist = append(allowlist, v)
+		}
+	}
+
+	var env []string
+	for _, v := range os.Environ() {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 && !isLogEnvAllowed(kv[0], allowlist) {
+			v = kv[0] + "=" + redactedValue
+		}
+		env = append(env, v)
+	}
+	return env
+}
+
+func isLogEnvAllowed(name string, allowlist []string) bool {
+	for _, v := range allowlist {
+		if strings.HasSuffix(v, "*") && strings.HasPrefix(name, strings.TrimSuffix(v, "*")) || v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fmtStatements formats statements for logging with the names of their parameters rather than their values
+func fmtStatements(statements []spanner.Statement) string {
+	var b strings.Builder
+	b.WriteString("[")
+	for i, v := range statements {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		var params []string
+		for k := range v.Params {
+			params = append(params, "@"+k)
+		}
+		sort.Strings(params)
+		fmt.Fprintf(&b, "{%q %v}", redact(v.SQL), params)
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// REDACTION <--------------------------------------------------
 
 // LOGGING >--------------------------------------------------
+const (
+	logFormatText = "text"
+	logFormatJson = "json"
+)
+
+var severityNames = map[Severity]string{
+	SeverityDebug:     "DEBUG",
+	SeverityInfo:      "INFO",
+	SeverityNotice:    "NOTICE",
+	SeverityWarning:   "WARNING",
+	SeverityError:     "ERROR",
+	SeverityEmergency: "EMERGENCY",
+}
+
+var textSeverityNames = map[Severity]string{
+	SeverityDebug:     "DEBUG",
+	SeverityInfo:      "INFO",
+	SeverityNotice:    "INFO",
+	SeverityWarning:   "WARN",
+	SeverityError:     "ERROR",
+	SeverityEmergency: "FATAL",
+}
+
 func newDefaultLogger(debug bool) *logger {
-	log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
+	level := Severity(SeverityInfo)
+	if debug {
+		level = SeverityDebug
+	}
+	return newLogger(logFormatText, level)
+}
 
+// newLogger creates a logger writing debug and info messages to stdout and more severe messages to stderr, either as
+// text, colored when writing to a terminal, or as JSON structured for Cloud Logging
+func newLogger(format string, level Severity) *logger {
 	return &logger{
-		debug:       debug,
-		debugLogger: log.New(os.Stdout, fmt.Sprintf("\x1b[%dmDEBUG ", colorDebug), log.Ldate|log.Ltime|log.Lmicroseconds),
-		infoLogger:  log.New(os.Stdout, fmt.Sprintf("\x1b[%dmINFO  ", colorInfo), log.Ldate|log.Ltime|log.Lmicroseconds),
-		warnLogger:  log.New(os.Stderr, fmt.Sprintf("\x1b[%dmWARN  ", colorWarn), log.Ldate|log.Ltime|log.Lmicroseconds),
-		errorLogger: log.New(os.Stderr, fmt.Sprintf("\x1b[%dmERROR ", colorError), log.Ldate|log.Ltime|log.Lmicroseconds),
-		fatalLogger: log.New(os.Stderr, fmt.Sprintf("\x1b[%dmFATAL ", colorFatal), log.Ldate|log.Ltime|log.Lmicroseconds),
+		level:  level,
+		json:   format == logFormatJson,
+		color:  format == logFormatText && isTerminal(os.Stdout) && isTerminal(os.Stderr) && os.Getenv("NO_COLOR") == "",
+		stdout: os.Stdout,
+		stderr: os.Stderr,
 	}
 }
 
 type logger struct {
-	debug       bool
-	debugLogger *log.Logger
-	infoLogger  *log.Logger
-	warnLogger  *log.Logger
-	errorLogger *log.Logger
-	fatalLogger *log.Logger
+	mu     sync.Mutex
+	level  Severity
+	json   bool
+	color  bool
+	stdout io.Writer
+	stderr io.Writer
+
+	// Fields added to every JSON log entry when set
+	runId    string
+	database string
+	revision int64
 }
 
-func logDebug(message string) {
-	if l.debug {
-		doLog(SeverityDebug, message)
+// configureLogger replaces the default logger according to the `log_format` and `log_level` command line arguments
+func configureLogger() error {
+	if logFormat != logFormatText && logFormat != logFormatJson {
+		return fmt.Errorf("unknown log format %q, expected %q or %q", logFormat, logFormatText, logFormatJson)
+	}
+	level, err := parseSeverity(logLevel)
+	if err != nil {
+		return err
+	}
+
+	runId := os.Getenv(configEnvVarPrefix + "RUN_ID")
+	if runId == "" {
+		runId = l.runId
+	}
+	if runId == "" {
+		runId = strings.ToLower(pseudoUuid())
+	}
+
+	newL := newLogger(logFormat, level)
+	newL.runId = runId
+	newL.database = spannerDatabaseId
+	l = newL
+	return nil
+}
+
+func parseSeverity(level string) (Severity, error) {
+	for k, v := range severityNames {
+		if strings.EqualFold(v, level) {
+			return k, nil
+		}
 	}
+	if strings.EqualFold(level, "warn") {
+		return SeverityWarning, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of debug, info, notice, warning or error", level)
+}
+
+// setLogRevision adds the revision of the migration being applied to log entries, or removes it if zero
+func setLogRevision(revision int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.revision = revision
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func logDebug(message string) {
+	doLog(SeverityDebug, message)
 }
 
 func logInfo(message string) {
@@ -591,39 +5274,97 @@ func logError(message string) {
 	doLog(SeverityError, message)
 }
 
-func logFatal(message string) {
-	doLog(SeverityEmergency, message)
+// logFatal logs the message and panics with a *migratexError so that main exits with the exit code of the category
+func logFatal(category errorCategory, message string) {
+	doLog(SeverityEmergency, fmt.Sprintf("%s: %s", category, message))
+	panic(&migratexError{category: category, message: message})
 }
 
 func doLog(severity Severity, message string) {
+	if severity < l.level && severity != SeverityEmergency {
+		return
+	}
+
 	pc, fileName, lineNumber, _ := runtime.Caller(2)
-	line := "line " + strconv.Itoa(lineNumber)
 	functionName := runtime.FuncForPC(pc).Name()
 
-	var logger *log.Logger
+	message = redact(message)
+
+	name, ok := severityNames[severity]
+	if !ok {
+		severity = SeverityError
+		name = severityNames[severity]
+		message = "MISSING LOG LEVEL, USING ERROR => " + message
+	}
+
+	l.mu.Lock()
+	var line string
+	if l.json {
+		line = fmtJsonLog(name, message, functionName, lineNumber, fileName)
+	} else {
+		line = fmtStdLog(severity, message, functionName, lineNumber, fileName)
+	}
+	w := l.stdout
+	if severity >= SeverityWarning {
+		w = l.stderr
+	}
+	fmt.Fprintln(w, line)
+	l.mu.Unlock()
+}
+
+// fmtStdLog formats a text log line, only adding the caller when debugging since it is otherwise noise
+func fmtStdLog(severity Severity, message, functionName string, lineNumber int, fileName string) string {
+	message = fmt.Sprintf("%-5s %s %s", textSeverityNames[severity], time.Now().Format("2006/01/02 15:04:05.000000"), message)
+	if l.level == SeverityDebug {
+		message = fmt.Sprintf("%s %s line %d %s", message, functionName, lineNumber, fileName)
+	}
+	if !l.color {
+		return message
+	}
+
+	var color int
 	switch severity {
 	case SeverityDebug:
-		logger = l.debugLogger
+		color = colorDebug
 	case SeverityInfo, SeverityNotice:
-		logger = l.infoLogger
+		color = colorInfo
 	case SeverityWarning:
-		logger = l.warnLogger
+		color = colorWarn
 	case SeverityError:
-		logger = l.errorLogger
-	case SeverityEmergency:
-		logger = l.fatalLogger
-		logger.Panicln(fmtStdLog(message, functionName, line, fileName))
-		return
+		color = colorError
 	default:
-		logger = l.errorLogger
-		message = "MISSING LOG LEVEL, USING ERROR => " + message
+		color = colorFatal
 	}
-	logger.Println(fmtStdLog(message, functionName, line, fileName))
+	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", color, message)
 }
 
-func fmtStdLog(message, functionName, line, fileName string) string {
-	message = fmt.Sprintf("%s %s %s %s", message, functionName, line, fileName)
-	return fmt.Sprintf("%s\x1b[0m", message)
+// fmtJsonLog formats a log entry using the special fields recognized by Cloud Logging, see
+// https://cloud.google.com/logging/docs/structured-logging
+func fmtJsonLog(severity, message, functionName string, lineNumber int, fileName string) string {
+	entry := map[string]interface{}{
+		"severity": severity,
+		"message":  message,
+		"time":     time.Now().Format(time.RFC3339Nano),
+		"logging.googleapis.com/sourceLocation": map[string]interface{}{
+			"file":     fileName,
+			"line":     strconv.Itoa(lineNumber),
+			"function": functionName,
+		},
+	}
+	if l.runId != "" {
+		entry["runId"] = l.runId
+	}
+	if l.database != "" {
+		entry["database"] = l.database
+	}
+	if l.revision > 0 {
+		entry["revision"] = l.revision
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Sprintf(`{"severity":"ERROR","message":%q}`, fmt.Sprintf("Failed formatting log entry %q: %v", message, err))
+	}
+	return string(b)
 }
 
 // LOGGING <--------------------------------------------------
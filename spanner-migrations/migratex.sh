@@ -145,7 +145,11 @@ fn_replace_tokens ()
 
     for KEY in ${KEYS[@]}; do
       VALUE=$(jq -r --arg key "${KEY}" '.[$key]' ${TOKEN_FILE})
-      log "Replacing '${KEY}' with '${VALUE}'"
+      if echo "${KEY}" | grep -qiE 'secret|password|passwd|token|api_?key|private_?key|credential'; then
+        log "Replacing '${KEY}' with '*****'"
+      else
+        log "Replacing '${KEY}' with '${VALUE}'"
+      fi
       TMP_FILE=${1}.tmp
       sed "s/@${KEY}@/${VALUE}/g" "${1}" > "${TMP_FILE}" && mv ${TMP_FILE} ${1}
     done
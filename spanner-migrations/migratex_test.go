@@ -0,0 +1,1024 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+
+	adminpb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fatal runs f and returns the category of the logFatal it panics with, if any
+func fatal(t *testing.T, f func()) (errorCategory, bool) {
+	t.Helper()
+	r := catchFatal(f)
+	if r == nil {
+		return 0, false
+	}
+	e, ok := r.(*migratexError)
+	if !ok {
+		t.Fatalf("Expected a *migratexError panic, got %v", r)
+	}
+	return e.category, true
+}
+
+func TestMigrationVersion(t *testing.T) {
+	tests := []struct {
+		migration string
+		version   int64
+		wantErr   bool
+	}{
+		{"1_foo.ddl.up.sql", 1, false},
+		{"007_foo_load.all.dml.sql", 7, false},
+		{"10_x.ddl.up.sql", 10, false},
+		{"0010_x.dev.dml.sql", 10, false},
+		{"foo_1.ddl.up.sql", 0, true},
+		{"R_view_active_users.ddl.sql", 0, true},
+	}
+	for _, tt := range tests {
+		version, err := migrationVersion(tt.migration)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("migrationVersion(%q) error = %v, wantErr %t", tt.migration, err, tt.wantErr)
+			continue
+		}
+		if version != tt.version {
+			t.Errorf("migrationVersion(%q) = %d, want %d", tt.migration, version, tt.version)
+		}
+	}
+}
+
+func TestSortMigrations(t *testing.T) {
+	tests := []struct {
+		name       string
+		migrations []string
+		want       []string
+	}{
+		{
+			name:       "numeric rather than lexical revision order",
+			migrations: []string{"10_x.ddl.up.sql", "9_y.ddl.up.sql"},
+			want:       []string{"9_y.ddl.up.sql", "10_x.ddl.up.sql"},
+		},
+		{
+			name:       "zero padding is ignored",
+			migrations: []string{"010_x.ddl.up.sql", "9_y.all.dml.sql", "0002_z.ddl.up.sql"},
+			want:       []string{"0002_z.ddl.up.sql", "9_y.all.dml.sql", "010_x.ddl.up.sql"},
+		},
+		{
+			name:       "DDL before DML at the same revision",
+			migrations: []string{"3_b.all.dml.sql", "3_a.ddl.up.sql", "2_c.all.dml.sql"},
+			want:       []string{"2_c.all.dml.sql", "3_a.ddl.up.sql", "3_b.all.dml.sql"},
+		},
+		{
+			name:       "file name order when the revision and kind are the same",
+			migrations: []string{"4_b.ddl.up.sql", "4_a.ddl.up.sql"},
+			want:       []string{"4_a.ddl.up.sql", "4_b.ddl.up.sql"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := append([]string(nil), tt.migrations...)
+			sortMigrations(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sortMigrations(%v) = %v, want %v", tt.migrations, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutstandingMigrations(t *testing.T) {
+	ddl := []string{"1_a.ddl.up.sql", "2_b.ddl.up.sql", "9_c.ddl.up.sql", "10_d.ddl.up.sql"}
+	dml := []string{"2_b.all.dml.sql", "9_c.all.dml.sql", "11_e.all.dml.sql"}
+
+	tests := []struct {
+		name             string
+		lastDdl, lastDml int64
+		wantDdl, wantDml []string
+		wantInconsistent bool
+	}{
+		{
+			name:    "nothing applied",
+			wantDdl: ddl,
+			wantDml: dml,
+		},
+		{
+			name:    "DDL of a revision applied before its DML",
+			lastDdl: 2, lastDml: 0,
+			wantDdl: []string{"9_c.ddl.up.sql", "10_d.ddl.up.sql"},
+			wantDml: dml,
+		},
+		{
+			name:    "DDL and DML of a revision applied",
+			lastDdl: 9, lastDml: 9,
+			wantDdl: []string{"10_d.ddl.up.sql"},
+			wantDml: []string{"11_e.all.dml.sql"},
+		},
+		{
+			name:    "revision 10 is after revision 9 despite sorting first lexically",
+			lastDdl: 10, lastDml: 9,
+			wantDml: []string{"11_e.all.dml.sql"},
+		},
+		{
+			name:    "everything applied",
+			lastDdl: 10, lastDml: 11,
+		},
+		{
+			name:    "DML of a revision applied before its DDL",
+			lastDdl: 1, lastDml: 2,
+			wantInconsistent: true,
+		},
+		{
+			name:    "DML of an earlier revision outstanding after later DDL",
+			lastDdl: 10, lastDml: 2,
+			wantInconsistent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotDdl, gotDml []string
+			category, failed := fatal(t, func() {
+				gotDdl, gotDml = outstandingMigrations(ddl, dml, tt.lastDdl, tt.lastDml)
+			})
+			if tt.wantInconsistent {
+				if !failed || category != errInconsistentState {
+					t.Fatalf("outstandingMigrations(%d, %d) failed = %t with category %v, want %v", tt.lastDdl, tt.lastDml, failed, category, errInconsistentState)
+				}
+				return
+			}
+			if failed {
+				t.Fatalf("outstandingMigrations(%d, %d) failed with category %v", tt.lastDdl, tt.lastDml, category)
+			}
+			if !reflect.DeepEqual(gotDdl, tt.wantDdl) || !reflect.DeepEqual(gotDml, tt.wantDml) {
+				t.Errorf("outstandingMigrations(%d, %d) = %v, %v, want %v, %v", tt.lastDdl, tt.lastDml, gotDdl, gotDml, tt.wantDdl, tt.wantDml)
+			}
+		})
+	}
+}
+
+// withDialect runs f with the dialect of the database set
+func withDialect(d adminpb.DatabaseDialect, f func()) {
+	defer func(previous adminpb.DatabaseDialect) {
+		dialect = previous
+	}(dialect)
+	dialect = d
+	f()
+}
+
+func TestDialectStatement(t *testing.T) {
+	tests := []struct {
+		name       string
+		dialect    adminpb.DatabaseDialect
+		sql        string
+		params     []interface{}
+		wantSql    string
+		wantParams map[string]interface{}
+	}{
+		{
+			name:       "GoogleSQL keeps named parameters",
+			dialect:    adminpb.DatabaseDialect_GOOGLE_STANDARD_SQL,
+			sql:        "UPDATE DataMigrations SET Dirty=@dirty WHERE Version=@version",
+			params:     []interface{}{"dirty", false, "version", int64(3)},
+			wantSql:    "UPDATE DataMigrations SET Dirty=@dirty WHERE Version=@version",
+			wantParams: map[string]interface{}{"dirty": false, "version": int64(3)},
+		},
+		{
+			name:       "PostgreSQL numbers parameters in the order given",
+			dialect:    adminpb.DatabaseDialect_POSTGRESQL,
+			sql:        "UPDATE DataMigrations SET Dirty=@dirty WHERE Version=@version",
+			params:     []interface{}{"dirty", false, "version", int64(3)},
+			wantSql:    "UPDATE DataMigrations SET Dirty=$1 WHERE Version=$2",
+			wantParams: map[string]interface{}{"p1": false, "p2": int64(3)},
+		},
+		{
+			name:       "PostgreSQL reuses the number of a repeated parameter",
+			dialect:    adminpb.DatabaseDialect_POSTGRESQL,
+			sql:        "DELETE FROM DataMigrations WHERE Version=@version AND Dirty=@dirty OR Version>@version",
+			params:     []interface{}{"dirty", true, "version", int64(4)},
+			wantSql:    "DELETE FROM DataMigrations WHERE Version=$2 AND Dirty=$1 OR Version>$2",
+			wantParams: map[string]interface{}{"p1": true, "p2": int64(4)},
+		},
+		{
+			name:       "PostgreSQL leaves unknown parameters",
+			dialect:    adminpb.DatabaseDialect_POSTGRESQL,
+			sql:        "SELECT @other",
+			wantSql:    "SELECT @other",
+			wantParams: map[string]interface{}{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDialect(tt.dialect, func() {
+				stmt := dialectStatement(tt.sql, tt.params...)
+				if stmt.SQL != tt.wantSql {
+					t.Errorf("dialectStatement(%q).SQL = %q, want %q", tt.sql, stmt.SQL, tt.wantSql)
+				}
+				if !reflect.DeepEqual(stmt.Params, tt.wantParams) {
+					t.Errorf("dialectStatement(%q).Params = %v, want %v", tt.sql, stmt.Params, tt.wantParams)
+				}
+			})
+		})
+	}
+}
+
+func TestIsDuplicateNameError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"GoogleSQL", status.Error(codes.FailedPrecondition, "Duplicate name in schema: SchemaMigrations."), true},
+		{"PostgreSQL lower case name", status.Error(codes.FailedPrecondition, "Duplicate name in schema: schemamigrations."), true},
+		{"another table", status.Error(codes.FailedPrecondition, "Duplicate name in schema: DataMigrations."), false},
+		{"another code", status.Error(codes.InvalidArgument, "Duplicate name in schema: SchemaMigrations."), false},
+		{"not a status", errors.New("Duplicate name in schema: SchemaMigrations."), false},
+	}
+	for _, tt := range tests {
+		if got := isDuplicateNameError(tt.err, "SchemaMigrations"); got != tt.want {
+			t.Errorf("isDuplicateNameError(%s) = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAddSecretIgnoresShortValues(t *testing.T) {
+	defer func(previous []string) {
+		secrets = previous
+	}(secrets)
+	secrets = nil
+
+	addSecret("API_TOKEN", "dev")
+	addSecret("DB_PASSWORD", "hunter2")
+	if got, want := redact("env dev with password hunter2"), "env dev with password "+redactedValue; got != want {
+		t.Errorf("redact() = %q, want %q", got, want)
+	}
+}
+
+func TestRedactQuotedSecrets(t *testing.T) {
+	defer func(previous []string) {
+		secrets = previous
+	}(secrets)
+	secrets = nil
+
+	secret := "s3cr\"et\\va\nlue"
+	addSecret("DB_PASSWORD", secret)
+	sql := fmt.Sprintf("UPDATE Users SET Password='%s' WHERE UserId=1;", secret)
+
+	for _, message := range []string{
+		redact(fmt.Sprintf("Created statement from SQL %q", sql)),
+		redact(fmtStatements([]spanner.Statement{{SQL: sql}})),
+		fmtStatements([]spanner.Statement{{SQL: sql}}),
+	} {
+		if strings.Contains(message, "s3cr") || strings.Contains(message, "lue") {
+			t.Errorf("Message %q contains the secret", message)
+		}
+		if !strings.Contains(message, redactedValue) {
+			t.Errorf("Message %q does not contain %q", message, redactedValue)
+		}
+	}
+}
+
+// parseTestCommandLine parses a command line, restoring the values of every flag when the test finishes
+func parseTestCommandLine(t *testing.T, args ...string) string {
+	t.Helper()
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	t.Cleanup(func() {
+		for k, v := range values {
+			flag.Set(k, v)
+		}
+	})
+	command, err := parseCommandLine(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return command
+}
+
+func TestResolveSettingsVerifyAllEnvs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, defaultConfigFile), []byte("environments:\n  dev:\n    log_level: warning\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parseTestCommandLine(t, commandVerify, "-all_envs", "-token_file", "tokens.json", "-config", filepath.Join(dir, defaultConfigFile))
+	t.Setenv("MIGRATEX_LOG_LEVEL", "debug")
+	t.Setenv("MIGRATEX_DATABASE_DIALECT", dialectPostgresql)
+
+	if err := resolveSettings(loadConfig(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if logLevel != "debug" || databaseDialect != dialectPostgresql {
+		t.Errorf("resolveSettings() set log_level %q and database_dialect %q, want the environment variables %q and %q", logLevel, databaseDialect, "debug", dialectPostgresql)
+	}
+
+	want := []string{"-config=" + filepath.Join(dir, defaultConfigFile), "-token_file=tokens.json"}
+	if got := commandLineArgs("config", "token_file", "log_level", "database_dialect"); !reflect.DeepEqual(got, want) {
+		t.Errorf("commandLineArgs() = %v, want %v", got, want)
+	}
+}
+
+func TestMigrateErrorCategory(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		stderr string
+		want   errorCategory
+	}{
+		{"dirty", context.Background(), "error: Dirty database version 3. Fix and force version.", errDirtyState},
+		{"failed statement", context.Background(), "error: migration failed in line 0: CREATE TABLE", errDdl},
+		{"interrupted", cancelled, "error: Dirty database version 3. Fix and force version.", errInterrupted},
+		{"locked", context.Background(), "error: can't acquire lock", errLockContention},
+	}
+	for _, tt := range tests {
+		if got := migrateErrorCategory(tt.ctx, tt.stderr); got != tt.want {
+			t.Errorf("migrateErrorCategory(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestContentionErrorCategory(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		retried bool
+		want    errorCategory
+	}{
+		{"claimed by a concurrent run", status.Error(codes.AlreadyExists, "Row [3] in table DataMigrations already exists"), false, errLockContention},
+		{"timed out retrying aborted transaction", status.Error(codes.DeadlineExceeded, "context deadline exceeded"), true, errLockContention},
+		{"timed out", context.DeadlineExceeded, false, errTimeout},
+		{"interrupted while retrying", context.Canceled, true, errInterrupted},
+		{"failed statement", status.Error(codes.InvalidArgument, "Table not found: Users"), true, errDml},
+	}
+	for _, tt := range tests {
+		if got := contentionErrorCategory(tt.err, tt.retried, errDml); got != tt.want {
+			t.Errorf("contentionErrorCategory(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReportDdlMigrationsAppliedAtOnce(t *testing.T) {
+	outstanding := []string{"2_b.ddl.up.sql", "3_c.ddl.up.sql", "4_d.ddl.up.sql"}
+	outcomes := func(r *runReport) []string {
+		var outcomes []string
+		for _, v := range r.Migrations {
+			outcomes = append(outcomes, v.Outcome)
+		}
+		return outcomes
+	}
+
+	tests := []struct {
+		name    string
+		version int64
+		dirty   bool
+		want    []string
+		ending  int64
+	}{
+		{"failed before first", 1, false, []string{outcomeFailed, outcomeSkipped, outcomeSkipped}, 1},
+		{"failed dirty", 3, true, []string{outcomeSucceeded, outcomeFailed, outcomeSkipped}, 2},
+		{"failed clean", 3, false, []string{outcomeSucceeded, outcomeSucceeded, outcomeFailed}, 3},
+	}
+	for _, tt := range tests {
+		r := &runReport{}
+		r.versions(1, 0)
+		r.pending(outstanding)
+		r.startedAll(outstanding)
+		r.reachedAll(tt.version, tt.dirty)
+		r.finish(errors.New("failed"))
+		if got := outcomes(r); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: outcomes = %v, want %v", tt.name, got, tt.want)
+		}
+		if r.StartingDdlVersion != 1 || r.EndingDdlVersion != tt.ending {
+			t.Errorf("%s: versions = %d..%d, want 1..%d", tt.name, r.StartingDdlVersion, r.EndingDdlVersion, tt.ending)
+		}
+	}
+
+	r := &runReport{}
+	r.versions(1, 0)
+	r.pending(outstanding)
+	r.startedAll(outstanding)
+	r.succeeded()
+	r.finish(nil)
+	if got, want := outcomes(r), []string{outcomeSucceeded, outcomeSucceeded, outcomeSucceeded}; !reflect.DeepEqual(got, want) {
+		t.Errorf("succeeded: outcomes = %v, want %v", got, want)
+	}
+	if r.EndingDdlVersion != 4 {
+		t.Errorf("succeeded: ending version = %d, want 4", r.EndingDdlVersion)
+	}
+}
+
+func TestReadHookSql(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hook.sql")
+	content := "-- Clears the cache\nDELETE FROM Cache -- of every user\nWHERE UserId = 'a';\n\n-- expect: rows=1\nUPDATE Users SET Active = true WHERE UserId = 'a';\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	statements, expectations, err := readHookSql(file)
+	if err != nil {
+		t.Fatalf("readHookSql() error = %v", err)
+	}
+	var got []string
+	for _, v := range statements {
+		got = append(got, v.SQL)
+	}
+	want := []string{"DELETE FROM Cache WHERE UserId = 'a';", "UPDATE Users SET Active = true WHERE UserId = 'a';"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readHookSql() statements = %q, want %q", got, want)
+	}
+	if len(expectations) != 2 || expectations[0] != nil || expectations[1] == nil || !expectations[1].matchesCount(1) {
+		t.Errorf("readHookSql() expectations = %v, want [<nil> 1]", expectations)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	parseTestCommandLine(t, "-timeout=5")
+
+	tests := []struct {
+		command      string
+		fleetTimeout string
+		deadline     time.Duration
+	}{
+		{commandUp, "", 5 * time.Minute},
+		{commandFleet, "", 0},
+		{commandFleet, "120", 120 * time.Minute},
+	}
+	for _, tt := range tests {
+		if tt.fleetTimeout != "" {
+			parseTestCommandLine(t, "-timeout=5", "-fleet_timeout="+tt.fleetTimeout)
+		}
+		ctx, cancel := runContext(tt.command)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if tt.deadline == 0 {
+			if ok {
+				t.Errorf("runContext(%s) deadline = %v, want none", tt.command, deadline)
+			}
+		} else if remaining := time.Until(deadline); !ok || remaining > tt.deadline || remaining < tt.deadline-time.Minute {
+			t.Errorf("runContext(%s) deadline in %v, want %v", tt.command, remaining, tt.deadline)
+		}
+	}
+}
+
+func TestReportStreamVersions(t *testing.T) {
+	defer setStream("")
+
+	r := &runReport{}
+	setStream("billing")
+	r.versions(3, 2)
+	r.started("4_a.ddl.up.sql")
+	r.succeeded()
+	if r.StartingDdlVersion != 3 || r.EndingDdlVersion != 4 || r.EndingDmlVersion != 2 {
+		t.Errorf("versions of only stream = %+v", r)
+	}
+
+	setStream("accounts")
+	r.versions(1, 1)
+	r.started("2_b.all.dml.sql")
+	r.succeeded()
+
+	want := []*streamReport{
+		{Name: "billing", StartingDdlVersion: 3, StartingDmlVersion: 2, EndingDdlVersion: 4, EndingDmlVersion: 2},
+		{Name: "accounts", StartingDdlVersion: 1, StartingDmlVersion: 1, EndingDdlVersion: 1, EndingDmlVersion: 2},
+	}
+	if !reflect.DeepEqual(r.Streams, want) {
+		t.Errorf("Streams = %+v, want %+v", r.Streams, want)
+	}
+	if r.StartingDdlVersion != 0 || r.EndingDdlVersion != 0 {
+		t.Errorf("versions of several streams = %d..%d, want 0..0", r.StartingDdlVersion, r.EndingDdlVersion)
+	}
+
+	var properties []string
+	for _, v := range r.junit().Properties {
+		properties = append(properties, v.Name+"="+v.Value)
+	}
+	for _, v := range []string{"billing.endingSchemaMigrationsVersion=4", "accounts.endingDataMigrationsVersion=2"} {
+		if !strings.Contains(strings.Join(properties, " "), v) {
+			t.Errorf("junit().Properties = %v, want %s", properties, v)
+		}
+	}
+}
+
+func TestCheckPolicies(t *testing.T) {
+	defer func(v bool) { outOfOrder = v }(outOfOrder)
+	environments := &environments{Environments: []string{"dev", "uat", "prod"}, Groups: map[string][]string{"nonprod": {"dev", "uat"}}}
+	withPolicy := &config{Policies: policiesConfig{OutOfOrder: "@nonprod"}}
+
+	tests := []struct {
+		name       string
+		config     *config
+		outOfOrder bool
+		env        string
+		wantErr    bool
+	}{
+		{"in order without config", nil, false, "prod", false},
+		{"without config", nil, true, "dev", true},
+		{"without policy", &config{}, true, "dev", true},
+		{"selected", withPolicy, true, "uat", false},
+		{"not selected", withPolicy, true, "prod", true},
+		{"in order not selected", withPolicy, false, "prod", false},
+	}
+	for _, tt := range tests {
+		outOfOrder = tt.outOfOrder
+		if err := tt.config.checkPolicies(tt.env, environments); (err != nil) != tt.wantErr {
+			t.Errorf("checkPolicies(%s) error = %v, wantErr %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLegacyAppliedMigrations(t *testing.T) {
+	ddl := []string{"1_a.ddl.up.sql", "2_b.ddl.up.sql", "10_c.ddl.up.sql", "11_d.ddl.up.sql"}
+	dml := []string{"2_b.all.dml.sql", "10_c.dev.dml.sql", "12_e.all.dml.sql"}
+
+	var got []string
+	for _, v := range legacyAppliedMigrations(ddl, dml, 10, 10) {
+		got = append(got, v.key())
+	}
+	want := []string{"1/ddl", "2/ddl", "2/dml", "10/ddl", "10/dml"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("legacyAppliedMigrations() = %v, want %v", got, want)
+	}
+
+	if got := legacyAppliedMigrations(ddl, dml, 0, 0); len(got) != 0 {
+		t.Errorf("legacyAppliedMigrations() of no versions = %v, want none", got)
+	}
+}
+
+func TestOutstandingHistoryMigrations(t *testing.T) {
+	defer func(v bool) { outOfOrder = v }(outOfOrder)
+	available := []string{"10_c.all.dml.sql", "2_b.all.dml.sql", "10_c.ddl.up.sql", "2_b.ddl.up.sql", "11_d.ddl.up.sql"}
+	history := func(keys ...string) []appliedMigration {
+		var history []appliedMigration
+		for _, v := range keys {
+			var m appliedMigration
+			fmt.Sscanf(strings.Replace(v, "/", " ", 1), "%d %s", &m.revision, &m.kind)
+			m.name = v
+			history = append(history, m)
+		}
+		return history
+	}
+
+	tests := []struct {
+		name           string
+		history        []appliedMigration
+		outOfOrder     bool
+		outstanding    []string
+		outOfOrderWant []string
+		fatal          errorCategory
+	}{
+		{"empty", nil, false, []string{"2_b.ddl.up.sql", "2_b.all.dml.sql", "10_c.ddl.up.sql", "10_c.all.dml.sql", "11_d.ddl.up.sql"}, nil, 0},
+		{"ddl before dml", history("2/ddl", "2/dml", "10/ddl"), false, []string{"10_c.all.dml.sql", "11_d.ddl.up.sql"}, nil, 0},
+		{"squashed", history("1/ddl", "2/ddl", "2/dml", "10/ddl", "10/dml"), false, []string{"11_d.ddl.up.sql"}, nil, 0},
+		{"dml before ddl", history("2/ddl", "2/dml", "10/dml"), false, nil, nil, errInconsistentState},
+		{"out of order", history("2/ddl", "2/dml", "10/dml"), true, []string{"10_c.ddl.up.sql", "11_d.ddl.up.sql"}, []string{"10_c.ddl.up.sql"}, 0},
+		{"dirty", append(history("2/ddl"), appliedMigration{revision: 2, kind: "dml", name: "2_b.all.dml.sql", dirty: true}), false, nil, nil, errDirtyState},
+	}
+	for _, tt := range tests {
+		outOfOrder = tt.outOfOrder
+		var outstanding, outOfOrderMigrations []string
+		category, failed := fatal(t, func() {
+			outstanding, outOfOrderMigrations = outstandingHistoryMigrations(available, tt.history)
+		})
+		if tt.fatal != 0 {
+			if !failed || category != tt.fatal {
+				t.Errorf("%s: outstandingHistoryMigrations() failed %t with %v, want %v", tt.name, failed, category, tt.fatal)
+			}
+			continue
+		}
+		if failed {
+			t.Errorf("%s: outstandingHistoryMigrations() failed with %v", tt.name, category)
+			continue
+		}
+		if !reflect.DeepEqual(outstanding, tt.outstanding) || !reflect.DeepEqual(outOfOrderMigrations, tt.outOfOrderWant) {
+			t.Errorf("%s: outstandingHistoryMigrations() = %v, %v, want %v, %v", tt.name, outstanding, outOfOrderMigrations, tt.outstanding, tt.outOfOrderWant)
+		}
+	}
+}
+
+func TestMigrationStatuses(t *testing.T) {
+	available := []string{"2_b.ddl.up.sql", "2_b.all.dml.sql", "10_c.ddl.up.sql", "11_d.ddl.up.sql"}
+	history := []appliedMigration{
+		{revision: 1, kind: "ddl", name: "1_a.ddl.up.sql"},
+		{revision: 2, kind: "ddl", name: "2_b.ddl.up.sql"},
+		{revision: 10, kind: "ddl", name: "10_c.ddl.up.sql", dirty: true},
+	}
+
+	var got []string
+	for _, v := range migrationStatuses(available, history) {
+		got = append(got, fmt.Sprintf("%s=%s", v.name, v.state))
+	}
+	want := []string{
+		"1_a.ddl.up.sql=" + statusUnavailable,
+		"2_b.ddl.up.sql=" + statusApplied,
+		"2_b.all.dml.sql=" + statusOutOfOrder,
+		"10_c.ddl.up.sql=" + statusDirty,
+		"11_d.ddl.up.sql=" + statusPending,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("migrationStatuses() = %v, want %v", got, want)
+	}
+}
+
+func TestParseEnvSelector(t *testing.T) {
+	declared := &environments{Environments: []string{"dev", "uat", "qa", "prod"}, Groups: map[string][]string{"nonprod": {"dev", "uat", "qa"}}}
+	undeclared := &environments{}
+	envs := []string{"dev", "uat", "qa", "prod"}
+
+	tests := []struct {
+		selector     string
+		environments *environments
+		want         []string
+		wantErr      bool
+	}{
+		{"dev", declared, []string{"dev"}, false},
+		{"+dev+uat", declared, []string{"dev", "uat"}, false},
+		{"dev+uat", declared, []string{"dev", "uat"}, false},
+		{"!prod", declared, []string{"dev", "uat", "qa"}, false},
+		{"@nonprod", declared, []string{"dev", "uat", "qa"}, false},
+		{"@nonprod!qa", declared, []string{"dev", "uat"}, false},
+		{"all!@nonprod", declared, []string{"prod"}, false},
+		{"all", undeclared, envs, false},
+		{"+dev+prdo", declared, nil, true},
+		{"!prdo", declared, nil, true},
+		{"@unknown", declared, nil, true},
+		{"!all", declared, nil, true},
+		{"dev uat", declared, nil, true},
+		{"+", declared, nil, true},
+		{"", declared, nil, true},
+		// Legacy file names join their environment segments, where unknown names never match
+		{"dev+uat", undeclared, []string{"dev", "uat"}, false},
+		{"!prdo", undeclared, nil, true},
+		{"@nonprod", undeclared, nil, true},
+	}
+	for _, tt := range tests {
+		s, err := parseEnvSelector(tt.selector, tt.environments)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseEnvSelector(%q) error = %v, wantErr %t", tt.selector, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var got []string
+		for _, v := range envs {
+			if s.matches(v) {
+				got = append(got, v)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseEnvSelector(%q) matches %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestMigrationSelectorLegacySegments(t *testing.T) {
+	dir := t.TempDir()
+	for _, v := range []string{"4_a.dev.uat.dml.sql", "5_b.all.dml.sql"} {
+		if err := os.WriteFile(filepath.Join(dir, v), []byte("DELETE FROM T WHERE Id = 1;\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := dmlMigrationSelector(dir, "4_a.dev.uat.dml.sql", &environments{})
+	if !s.matches("dev") || !s.matches("uat") || s.matches("prod") {
+		t.Errorf("dmlMigrationSelector(4_a.dev.uat.dml.sql) = %+v, want dev and uat", s)
+	}
+	if s := dmlMigrationSelector(dir, "5_b.all.dml.sql", &environments{}); !s.matches("prod") {
+		t.Errorf("dmlMigrationSelector(5_b.all.dml.sql) = %+v, want every environment", s)
+	}
+}
+
+func TestMigrationSelectorRequiresDeclaredEnvironments(t *testing.T) {
+	dir := t.TempDir()
+	for k, v := range map[string]string{"4_a.+dve.dml.sql": "", "5_b.dml.sql": "-- migratex: env=@nonprd\n", "6_c.dev.dml.sql": ""} {
+		if err := os.WriteFile(filepath.Join(dir, k), []byte(v+"DELETE FROM T WHERE Id = 1;\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, v := range []string{"4_a.+dve.dml.sql", "5_b.dml.sql"} {
+		if category, ok := fatal(t, func() { dmlMigrationSelector(dir, v, &environments{}) }); !ok || category != errDiscovery {
+			t.Errorf("dmlMigrationSelector(%s) without declared environments = %v, %t, want %v", v, category, ok, errDiscovery)
+		}
+	}
+	if _, ok := fatal(t, func() { dmlMigrationSelector(dir, "6_c.dev.dml.sql", &environments{}) }); ok {
+		t.Errorf("dmlMigrationSelector(6_c.dev.dml.sql) without declared environments failed, want legacy segments allowed")
+	}
+
+	declared := &environments{Environments: []string{"dev", "prod"}}
+	if category, ok := fatal(t, func() { dmlMigrationSelector(dir, "4_a.+dve.dml.sql", declared) }); !ok || category != errDiscovery {
+		t.Errorf("dmlMigrationSelector(4_a.+dve.dml.sql) = %v, %t, want %v", category, ok, errDiscovery)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		expects []string
+		wantErr bool
+	}{
+		{"statements", "SELECT 1;\nSELECT\n  2;\n", []string{"SELECT 1", "SELECT 2"}, []string{"", ""}, false},
+		{"comment lines", "-- first\nSELECT 1;\n  -- second\nSELECT 2", []string{"SELECT 1", "SELECT 2"}, []string{"", ""}, false},
+		{"trailing comment", "DELETE FROM T -- every stale row\nWHERE Stale = true;", []string{"DELETE FROM T WHERE Stale = true"}, []string{""}, false},
+		{"expectation", "-- expect: rows=2\nUPDATE T SET A = 1 WHERE B = 2;\nSELECT 1;", []string{"UPDATE T SET A = 1 WHERE B = 2", "SELECT 1"}, []string{"rows=2", ""}, false},
+		{"semicolon in string", "INSERT INTO T (A) VALUES ('a;b');\nSELECT \"c;d\";", []string{"INSERT INTO T (A) VALUES ('a;b')", "SELECT \"c;d\""}, []string{"", ""}, false},
+		{"comment in string", "SELECT '-- not a comment' FROM T;", []string{"SELECT '-- not a comment' FROM T"}, []string{""}, false},
+		{"escaped quote", "SELECT 'it\\'s; fine';\nSELECT `a;b` FROM T;", []string{"SELECT 'it\\'s; fine'", "SELECT `a;b` FROM T"}, []string{"", ""}, false},
+		{"multi-line string", "SELECT '''a;\n-- b''';\nSELECT 2;", []string{"SELECT '''a; -- b'''", "SELECT 2"}, []string{"", ""}, false},
+		{"trailing expectation", "SELECT 1; -- expect: rows=1\n", nil, nil, true},
+		{"double expectation", "-- expect: rows=1\n-- expect: rows=2\nSELECT 1;", nil, nil, true},
+		{"expectation without statement", "SELECT 1;\n-- expect: rows=1\n", nil, nil, true},
+		{"unterminated string", "SELECT 'a;\nSELECT 2;", nil, nil, true},
+		{"block comment", "/* backfill users' emails */\nUPDATE Users SET Email = LOWER(Email) WHERE Email IS NOT NULL;", []string{"UPDATE Users SET Email = LOWER(Email) WHERE Email IS NOT NULL"}, []string{""}, false},
+		{"semicolon in block comment", "SELECT 1 /* not; the end */ FROM T;", []string{"SELECT 1 FROM T"}, []string{""}, false},
+		{"multi-line block comment", "SELECT 1; /* first;\n-- expect: rows=1\n'second */ SELECT 2;", []string{"SELECT 1", "SELECT 2"}, []string{"", ""}, false},
+		{"block comment in string", "SELECT '/* not a comment */' FROM T;", []string{"SELECT '/* not a comment */' FROM T"}, []string{""}, false},
+		{"unterminated block comment", "SELECT 1; /* the end;\nSELECT 2;", nil, nil, true},
+	}
+	for _, tt := range tests {
+		statements, err := splitStatements(tt.content)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("splitStatements(%s) error = %v, wantErr %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		var got, expects []string
+		for _, v := range statements {
+			got = append(got, v.sql)
+			expect := ""
+			if v.expect != nil {
+				expect = v.expect.String()
+			}
+			expects = append(expects, expect)
+		}
+		if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(expects, tt.expects) {
+			t.Errorf("splitStatements(%s) = %q with expectations %q, want %q with %q", tt.name, got, expects, tt.want, tt.expects)
+		}
+	}
+
+	withDialect(adminpb.DatabaseDialect_POSTGRESQL, func() {
+		statements, err := splitStatements("INSERT INTO t (a) VALUES ('C:\\'), ('it''s; fine');\nSELECT 2;")
+		if err != nil || len(statements) != 2 || statements[0].sql != "INSERT INTO t (a) VALUES ('C:\\'), ('it''s; fine')" {
+			t.Errorf("splitStatements() of PostgreSQL strings = %+v, %v", statements, err)
+		}
+	})
+}
+
+func TestPendingRepeatableMigrations(t *testing.T) {
+	repeatable := []repeatableMigration{
+		{name: "R_a.ddl.sql", checksum: "1"},
+		{name: "R_b.ddl.sql", checksum: "2"},
+		{name: "R_c.ddl.sql", checksum: "3"},
+	}
+	checksums := map[string]string{"R_a.ddl.sql": "1", "R_b.ddl.sql": "old", "R_removed.ddl.sql": "4"}
+
+	names := func(migrations []repeatableMigration) []string {
+		var names []string
+		for _, v := range migrations {
+			names = append(names, v.name)
+		}
+		return names
+	}
+	unchanged, pending := pendingRepeatableMigrations(repeatable, checksums)
+	if got, want := names(unchanged), []string{"R_a.ddl.sql"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pendingRepeatableMigrations() unchanged = %v, want %v", got, want)
+	}
+	if got, want := names(pending), []string{"R_b.ddl.sql", "R_c.ddl.sql"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pendingRepeatableMigrations() pending = %v, want %v", got, want)
+	}
+}
+
+func TestSplitSchema(t *testing.T) {
+	schema := `-- Users of the app
+CREATE TABLE Users ( -- every user
+  Id INT64 NOT NULL,
+  Status STRING(16) NOT NULL DEFAULT ('new;pending'), -- a default with a semicolon
+  CONSTRAINT StatusKnown CHECK (Status != ';'),
+) PRIMARY KEY (Id);
+
+CREATE INDEX UsersByStatus ON Users(Status);
+`
+	want := []string{
+		"CREATE TABLE Users ( Id INT64 NOT NULL, Status STRING(16) NOT NULL DEFAULT ('new;pending'), CONSTRAINT StatusKnown CHECK (Status != ';'), ) PRIMARY KEY (Id)",
+		"CREATE INDEX UsersByStatus ON Users(Status)",
+	}
+	got, err := splitSchema(schema)
+	if err != nil {
+		t.Fatalf("splitSchema() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitSchema() = %q, want %q", got, want)
+	}
+}
+
+func TestParseSchemaObjects(t *testing.T) {
+	tests := []struct {
+		statement string
+		want      []schemaObject
+	}{
+		{
+			"CREATE TABLE Users (\n  Id INT64 NOT NULL,\n  OrgId INT64,\n  CONSTRAINT FK_Org FOREIGN KEY (OrgId) REFERENCES Orgs (Id),\n  CHECK (Id > 0),\n) PRIMARY KEY (Id)",
+			[]schemaObject{
+				{kind: "table", name: "Users", definition: "PRIMARY KEY (Id)"},
+				{kind: "column", name: "Users.Id", table: "Users", definition: "INT64 NOT NULL"},
+				{kind: "column", name: "Users.OrgId", table: "Users", definition: "INT64"},
+				{kind: "constraint", name: "Users.FK_Org", table: "Users", definition: "FOREIGN KEY (OrgId) REFERENCES Orgs (Id)"},
+				{kind: "constraint", name: "Users.CHECK (Id > 0)", table: "Users", definition: "CHECK (Id > 0)"},
+			},
+		},
+		{
+			`CREATE TABLE "users" (id bigint NOT NULL, name character varying, PRIMARY KEY(id))`,
+			[]schemaObject{
+				{kind: "table", name: "users", definition: "PRIMARY KEY(id)"},
+				{kind: "column", name: "users.id", table: "users", definition: "bigint NOT NULL"},
+				{kind: "column", name: "users.name", table: "users", definition: "character varying"},
+			},
+		},
+		{
+			"CREATE UNIQUE INDEX UsersByName ON Users(Name)",
+			[]schemaObject{{kind: "index", name: "UsersByName", table: "Users", definition: "CREATE UNIQUE INDEX UsersByName ON Users(Name)"}},
+		},
+		{
+			"ALTER TABLE Users ADD CONSTRAINT FK_Org FOREIGN KEY (OrgId) REFERENCES Orgs (Id)",
+			[]schemaObject{{kind: "constraint", name: "Users.FK_Org", table: "Users", definition: "FOREIGN KEY (OrgId) REFERENCES Orgs (Id)"}},
+		},
+		{
+			"CREATE VIEW ActiveUsers SQL SECURITY INVOKER AS SELECT Id FROM Users",
+			[]schemaObject{{kind: "view", name: "ActiveUsers", definition: "CREATE VIEW ActiveUsers SQL SECURITY INVOKER AS SELECT Id FROM Users"}},
+		},
+		{
+			"ALTER DATABASE db SET OPTIONS (version_retention_period = '7d')",
+			[]schemaObject{{kind: "statement", name: "ALTER DATABASE db SET OPTIONS (version_retention_period = '7d')", definition: "ALTER DATABASE db SET OPTIONS (version_retention_period = '7d')"}},
+		},
+	}
+	for _, tt := range tests {
+		if got := parseSchemaObjects([]string{tt.statement}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSchemaObjects(%q) = %+v, want %+v", tt.statement, got, tt.want)
+		}
+	}
+}
+
+func TestSplitTableDefinition(t *testing.T) {
+	tests := []struct {
+		definition   string
+		wantElements []string
+		wantOptions  string
+	}{
+		{"Id INT64 NOT NULL, Name STRING(MAX), ) PRIMARY KEY (Id)", []string{"Id INT64 NOT NULL", "Name STRING(MAX)"}, "PRIMARY KEY (Id)"},
+		{"id bigint, amount numeric(10, 2), PRIMARY KEY(id))", []string{"id bigint", "amount numeric(10, 2)", "PRIMARY KEY(id)"}, ""},
+		{"Id INT64, CONSTRAINT Positive CHECK (Id > 0)) PRIMARY KEY (Id), INTERLEAVE IN PARENT Orgs", []string{"Id INT64", "CONSTRAINT Positive CHECK (Id > 0)"}, "PRIMARY KEY (Id), INTERLEAVE IN PARENT Orgs"},
+	}
+	for _, tt := range tests {
+		elements, options := splitTableDefinition(tt.definition)
+		if !reflect.DeepEqual(elements, tt.wantElements) || options != tt.wantOptions {
+			t.Errorf("splitTableDefinition(%q) = %q, %q, want %q, %q", tt.definition, elements, options, tt.wantElements, tt.wantOptions)
+		}
+	}
+}
+
+func TestDiffSchemaObjects(t *testing.T) {
+	schema := func(statements ...string) []schemaObject {
+		return parseSchemaObjects(statements)
+	}
+	tests := []struct {
+		name     string
+		expected []schemaObject
+		actual   []schemaObject
+		want     []string
+	}{
+		{
+			"identical",
+			schema("CREATE TABLE Users (Id INT64) PRIMARY KEY (Id)", "CREATE INDEX UsersById ON Users(Id)"),
+			schema("CREATE INDEX UsersById ON Users(Id)", "CREATE TABLE Users (Id INT64) PRIMARY KEY (Id)"),
+			nil,
+		},
+		{
+			"missing table",
+			schema("CREATE TABLE Users (Id INT64, CONSTRAINT Positive CHECK (Id > 0)) PRIMARY KEY (Id)"),
+			nil,
+			[]string{`Missing table "Users": PRIMARY KEY (Id)`},
+		},
+		{
+			"extra table",
+			nil,
+			schema("CREATE TABLE Users (Id INT64, Name STRING(MAX)) PRIMARY KEY (Id)"),
+			[]string{`Extra table "Users": PRIMARY KEY (Id)`},
+		},
+		{
+			"altered column and missing index",
+			schema("CREATE TABLE Users (Id INT64, Name STRING(MAX)) PRIMARY KEY (Id)", "CREATE INDEX UsersByName ON Users(Name)"),
+			schema("CREATE TABLE Users (Id INT64, Name STRING(64)) PRIMARY KEY (Id)"),
+			[]string{
+				`Altered column "Users.Name": expected STRING(MAX) but found STRING(64)`,
+				`Missing index "UsersByName": CREATE INDEX UsersByName ON Users(Name)`,
+			},
+		},
+		{
+			"extra unnamed constraint",
+			schema("CREATE TABLE Users (Id INT64) PRIMARY KEY (Id)"),
+			schema("CREATE TABLE Users (Id INT64, CHECK (Id > 0)) PRIMARY KEY (Id)"),
+			[]string{`Extra constraint "Users.CHECK (Id > 0)": CHECK (Id > 0)`},
+		},
+	}
+	for _, tt := range tests {
+		if got := diffSchemaObjects(tt.expected, tt.actual); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("diffSchemaObjects(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsDestructiveStatement(t *testing.T) {
+	tests := []struct {
+		dialect adminpb.DatabaseDialect
+		sql     string
+		want    bool
+	}{
+		{adminpb.DatabaseDialect_GOOGLE_STANDARD_SQL, "DELETE FROM Sessions WHERE TRUE", true},
+		{adminpb.DatabaseDialect_GOOGLE_STANDARD_SQL, "delete from Sessions where true;", true},
+		{adminpb.DatabaseDialect_GOOGLE_STANDARD_SQL, "UPDATE Users SET Active = false WHERE 1=1", true},
+		{adminpb.DatabaseDialect_GOOGLE_STANDARD_SQL, "UPDATE Users SET Active = false WHERE 1 = 1", true},
+		{adminpb.DatabaseDialect_GOOGLE_STANDARD_SQL, "DELETE FROM Sessions WHERE Expired = TRUE", false},
+		{adminpb.DatabaseDialect_GOOGLE_STANDARD_SQL, "DELETE FROM Sessions WHERE TRUE AND Expired", false},
+		{adminpb.DatabaseDialect_GOOGLE_STANDARD_SQL, "INSERT INTO Sessions (Id) SELECT Id FROM Users WHERE TRUE", false},
+		{adminpb.DatabaseDialect_POSTGRESQL, "DELETE FROM sessions", true},
+		{adminpb.DatabaseDialect_POSTGRESQL, "UPDATE users SET active = false;", true},
+		{adminpb.DatabaseDialect_POSTGRESQL, "DELETE FROM sessions WHERE TRUE", true},
+		{adminpb.DatabaseDialect_POSTGRESQL, "DELETE FROM sessions WHERE expired", false},
+		{adminpb.DatabaseDialect_POSTGRESQL, "INSERT INTO sessions (id) VALUES (1)", false},
+	}
+	for _, tt := range tests {
+		withDialect(tt.dialect, func() {
+			if got := isDestructiveStatement(tt.sql); got != tt.want {
+				t.Errorf("isDestructiveStatement(%q) in %v = %t, want %t", tt.sql, tt.dialect, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMigrationDirectives(t *testing.T) {
+	tests := []struct {
+		name           string
+		migration      string
+		wantDirectives map[string]string
+		wantBody       string
+		wantErr        bool
+	}{
+		{"none", "DELETE FROM T WHERE Id = 1;", map[string]string{}, "DELETE FROM T WHERE Id = 1;", false},
+		{"header", "-- migratex: env=!prod, transaction=none\n-- migratex: allow_destructive=true\nDELETE FROM T WHERE TRUE;", map[string]string{"env": "!prod", "transaction": "none", "allow_destructive": "true"}, "DELETE FROM T WHERE TRUE;", false},
+		{"after comments", "-- clears T\n\n-- migratex: priority=low\nDELETE FROM T WHERE Id = 1;", map[string]string{"priority": "low"}, "-- clears T\n\nDELETE FROM T WHERE Id = 1;", false},
+		{"after first statement", "DELETE FROM T WHERE Id = 1;\n-- migratex: priority=low", map[string]string{}, "DELETE FROM T WHERE Id = 1;\n-- migratex: priority=low", false},
+		{"unknown", "-- migratex: parallel=true\nSELECT 1;", nil, "", true},
+		{"not key value", "-- migratex: allow_destructive\nSELECT 1;", nil, "", true},
+		{"duplicate", "-- migratex: priority=low, priority=high\nSELECT 1;", nil, "", true},
+	}
+	for _, tt := range tests {
+		directives, body, err := parseMigrationDirectives(tt.migration)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMigrationDirectives(%s) error = %v, wantErr %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(directives, tt.wantDirectives) || body != tt.wantBody {
+			t.Errorf("parseMigrationDirectives(%s) = %v, %q, want %v, %q", tt.name, directives, body, tt.wantDirectives, tt.wantBody)
+		}
+	}
+}
+
+func TestFleetDatabases(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "databases.txt")
+	if err := os.WriteFile(f, []byte("# tenants\ntenant-a\n\ntenant-b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &config{Environments: map[string]environmentConfig{"uat": {Databases: []string{"tenant-c"}}}, file: defaultConfigFile}
+
+	parseTestCommandLine(t, commandFleet, "-env_id", "uat")
+	if got, want := fleetDatabases(context.Background(), c), []string{"tenant-c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fleetDatabases() = %v, want %v", got, want)
+	}
+
+	parseTestCommandLine(t, commandFleet, "-env_id", "dev", "-databases_file", f)
+	if got, want := fleetDatabases(context.Background(), c), []string{"tenant-a", "tenant-b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fleetDatabases() = %v, want %v", got, want)
+	}
+
+	parseTestCommandLine(t, commandFleet, "-env_id", "uat", "-databases_file", f)
+	if category, ok := fatal(t, func() { fleetDatabases(context.Background(), c) }); !ok || category != errConfiguration {
+		t.Errorf("fleetDatabases() with a databases file and config databases = %v, %t, want %v", category, ok, errConfiguration)
+	}
+}